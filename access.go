@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Role int
+
+// Roles are ordered: each one can do everything the previous ones can.
+const (
+	NoRole Role = iota
+	ViewerRole
+	OperatorRole
+	AdminRole
+	OwnerRole
+)
+
+var roleToString = map[Role]string{
+	NoRole:       "none",
+	ViewerRole:   "viewer",
+	OperatorRole: "operator",
+	AdminRole:    "admin",
+	OwnerRole:    "owner",
+}
+
+func (r Role) String() string {
+	return roleToString[r]
+}
+
+func parseRole(s string) (Role, bool) {
+	for role, name := range roleToString {
+		if role != NoRole && strings.EqualFold(name, s) {
+			return role, true
+		}
+	}
+	return NoRole, false
+}
+
+// RoleBinding grants a role to Telegram users and to every member of chats.
+// Chats are referenced by name: ChatConfigs, ChatAdminConfig or AdminChats.
+type RoleBinding struct {
+	Role    string
+	UserIds []string `json:",omitempty"`
+	Chats   []string `json:",omitempty"`
+}
+
+// Minimum role needed by each command. Commands not listed here are public.
+var commandRoles = map[string]Role{
+	"/help":              ViewerRole,
+	"/state":             ViewerRole,
+	"/proc_list":         ViewerRole,
+	"/pause":             OperatorRole,
+	"/play":              OperatorRole,
+	"/check":             OperatorRole,
+	"/errors":            ViewerRole,
+	"/mute":              AdminRole,
+	"/unmute":            AdminRole,
+	"/severity":          OwnerRole,
+	"/min_severity":      OwnerRole,
+	"/reload":            OwnerRole,
+	"/proc_add":          OwnerRole,
+	"/proc_rm":           OwnerRole,
+	"/proc_set_template": OwnerRole,
+}
+
+// chatIdByName returns the id of the admin chat or chat named name.
+func (bc *BotConfig) chatIdByName(name string) (string, bool) {
+	for _, admin := range bc.allAdminChats() {
+		if strings.EqualFold(admin.Name, name) {
+			return admin.ChatId, true
+		}
+	}
+	if chat := bc.findChat(name); chat != nil {
+		return chat.ChatId, true
+	}
+	return "", false
+}
+
+// roleOf returns the highest role granted to the sender or to the chat of the
+// update. The admin chats and AdminUserIds are owners.
+func roleOf(c tele.Context, bc *BotConfig) Role {
+	var chatId, userId string
+	if chat := c.Chat(); chat != nil {
+		chatId = strconv.FormatInt(chat.ID, 10)
+	}
+	if sender := c.Sender(); sender != nil {
+		userId = strconv.FormatInt(sender.ID, 10)
+	}
+
+	for _, admin := range bc.allAdminChats() {
+		if chatId != "" && admin.ChatId == chatId {
+			return OwnerRole
+		}
+	}
+	for _, id := range bc.AdminUserIds {
+		if userId != "" && id == userId {
+			return OwnerRole
+		}
+	}
+
+	role := NoRole
+	for _, binding := range bc.Roles {
+		bindingRole, ok := parseRole(binding.Role)
+		if !ok || bindingRole <= role {
+			continue
+		}
+
+		granted := false
+		for _, id := range binding.UserIds {
+			granted = granted || (userId != "" && id == userId)
+		}
+		for _, name := range binding.Chats {
+			id, ok := bc.chatIdByName(name)
+			granted = granted || (ok && chatId != "" && id == chatId)
+		}
+
+		if granted {
+			role = bindingRole
+		}
+	}
+
+	return role
+}
+
+// commandOf returns the command of a text message, without the bot username
+// Telegram appends in groups (/check@my_bot).
+func commandOf(c tele.Context) string {
+	if c.Callback() != nil || c.Message() == nil {
+		return ""
+	}
+
+	text := c.Message().Text
+	if !strings.HasPrefix(text, "/") {
+		return ""
+	}
+
+	command, _, _ := strings.Cut(strings.Fields(text)[0], "@")
+	return command
+}
+
+type auditEntry struct {
+	Time     time.Time
+	Command  string
+	Args     string `json:",omitempty"`
+	UserId   int64  `json:",omitempty"`
+	Username string `json:",omitempty"`
+	ChatId   int64  `json:",omitempty"`
+	Role     string
+	Allowed  bool
+}
+
+// auditLog records who ran which command, allowed or not. Entries are always
+// logged and, if path is set, appended as JSON lines to that file.
+type auditLog struct {
+	mu sync.Mutex
+}
+
+func (a *auditLog) Record(path string, c tele.Context, command string, role Role, allowed bool) {
+	entry := auditEntry{
+		Time:    time.Now().UTC(),
+		Command: command,
+		Role:    role.String(),
+		Allowed: allowed,
+	}
+	if msg := c.Message(); msg != nil {
+		entry.Args = msg.Payload
+	}
+	if sender := c.Sender(); sender != nil {
+		entry.UserId = sender.ID
+		entry.Username = sender.Username
+	}
+	if chat := c.Chat(); chat != nil {
+		entry.ChatId = chat.ID
+	}
+
+	slog.Info("Audit",
+		"command", entry.Command,
+		"args", entry.Args,
+		"user_id", entry.UserId,
+		"username", entry.Username,
+		"chat_id", entry.ChatId,
+		"role", entry.Role,
+		"allowed", entry.Allowed,
+	)
+
+	if path == "" {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Could not JSON encode audit entry", "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		slog.Error("Could not open audit log", "path", path, "error", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		slog.Error("Could not write to audit log", "path", path, "error", err)
+	}
+}
+
+// requireRoles is a middleware that only lets restricted commands through
+// when the sender has the role the command needs, recording every command.
+func requireRoles(lc *liveConfig, audit *auditLog) tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			command := commandOf(c)
+			if command == "" {
+				return next(c)
+			}
+
+			bc := lc.Get()
+			role := roleOf(c, bc)
+			required, restricted := commandRoles[command]
+			allowed := !restricted || role >= required
+			audit.Record(bc.AuditLogPath, c, command, role, allowed)
+			if !allowed {
+				return nil
+			}
+			return next(c)
+		}
+	}
+}
+
+// usageFor lists the commands available with the given role.
+func usageFor(role Role) string {
+	usage := "Commands:\n"
+	for _, c := range commands {
+		if required, restricted := commandRoles[c.Text]; restricted && role < required {
+			continue
+		}
+		usage += fmt.Sprintf("<code>%s</code>  %s\n", c.Text, c.Description)
+	}
+
+	return usage
+}
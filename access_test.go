@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	tele "gopkg.in/telebot.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestContext(t *testing.T, chatId, userId int64, text string) tele.Context {
+	bot, err := tele.NewBot(tele.Settings{Offline: true})
+	if err != nil {
+		t.Fatalf("could not create bot: %s\n", err)
+	}
+
+	return bot.NewContext(tele.Update{Message: &tele.Message{
+		Chat:   &tele.Chat{ID: chatId},
+		Sender: &tele.User{ID: userId},
+		Text:   text,
+	}})
+}
+
+func TestRoleOf(t *testing.T) {
+	bc := BotConfig{
+		ChatAdminConfig: &ChatAdminConfig{ChatId: "-100", Name: "admin"},
+		AdminChats:      []ChatAdminConfig{{ChatId: "-200", Name: "admin_2"}},
+		AdminUserIds:    []string{"42"},
+		ChatConfigs:     []ChatConfig{{ChatId: "-300", Name: "chat_1"}},
+		Roles: []RoleBinding{
+			{Role: "viewer", Chats: []string{"chat_1"}},
+			{Role: "operator", UserIds: []string{"7"}},
+			{Role: "admin", UserIds: []string{"8"}},
+		},
+	}
+
+	var tests = []struct {
+		name   string
+		chatId int64
+		userId int64
+		want   Role
+	}{
+		{"AdminChat", -100, 1, OwnerRole},
+		{"OtherAdminChat", -200, 1, OwnerRole},
+		{"AdminUser", -300, 42, OwnerRole},
+		{"ViewerChat", -300, 1, ViewerRole},
+		{"OperatorUser", 7, 7, OperatorRole},
+		{"HighestRole", -300, 8, AdminRole},
+		{"Nobody", -400, 1, NoRole},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestContext(t, tt.chatId, tt.userId, "")
+			if got := roleOf(c, &bc); got != tt.want {
+				t.Errorf(errFmtString, tt.want, got)
+			}
+		})
+	}
+
+	t.Run("NoAdmins", func(t *testing.T) {
+		if got := roleOf(newTestContext(t, -100, 42, ""), &BotConfig{}); got != NoRole {
+			t.Errorf(errFmtString, NoRole, got)
+		}
+	})
+}
+
+func TestRequireRoles(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+	lc := newLiveConfig("", BotConfig{
+		AuditLogPath: auditPath,
+		Roles:        []RoleBinding{{Role: "operator", UserIds: []string{"7"}}},
+	})
+	handler := requireRoles(lc, &auditLog{})(func(c tele.Context) error {
+		return os.ErrExist // tells the handler was called
+	})
+
+	var tests = []struct {
+		name string
+		text string
+		want bool
+	}{
+		{"Allowed", "/check Test1", true},
+		{"AllowedWithBotName", "/pause@aemet_bot", true},
+		{"Denied", "/proc_rm chat_1 Test1", false},
+		{"Public", "/latest Test1", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := handler(newTestContext(t, 7, 7, tt.text)) == os.ErrExist
+			if called != tt.want {
+				t.Errorf("want: handler called %t; got: %t\n", tt.want, called)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("could not read audit log: %s\n", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("want: 4 audit entries; got: %d\n", len(lines))
+	}
+
+	var entry auditEntry
+	if err := json.Unmarshal([]byte(lines[2]), &entry); err != nil {
+		t.Fatalf("could not decode audit entry: %s\n", err)
+	}
+	if entry.Command != "/proc_rm" || entry.UserId != 7 || entry.Role != "operator" || entry.Allowed {
+		t.Errorf("want: denied /proc_rm by operator 7; got: %+v\n", entry)
+	}
+	if err := json.Unmarshal([]byte(lines[3]), &entry); err != nil || entry.Command != "/latest" || !entry.Allowed {
+		t.Errorf("want: public /latest recorded as allowed; got: %+v (%v)\n", entry, err)
+	}
+}
+
+func TestUsageFor(t *testing.T) {
+	usage := usageFor(OperatorRole)
+	for _, command := range []string{"/check", "/latest", "/state"} {
+		if !strings.Contains(usage, command) {
+			t.Errorf("want: '%s' listed for operators; got: '%s'\n", command, usage)
+		}
+	}
+	for _, command := range []string{"/proc_add", "/reload", "/mute"} {
+		if strings.Contains(usage, command) {
+			t.Errorf("want: '%s' hidden from operators; got: '%s'\n", command, usage)
+		}
+	}
+}
@@ -1,218 +1,460 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	tele "gopkg.in/telebot.v3"
-	"log"
+	"html"
+	"io"
+	"io/fs"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type ProcessingErrorCode int
-
-const (
-	SendMessageError ProcessingErrorCode = iota + 1
-	ReadTemplateError
-	ReadRegistryError
-	WriteRegistryError
-	UnmarshalRegistryError
-	MarshalRegistryError
-	GetUrlContentError
-	BlankPDFDateError
-)
+// formatPDFMessage fills a message template with the pdf info. Templates take,
+// in order: selective process name, base url, pdf url and pdf name.
+func formatPDFMessage(template string, sp *SelectiveProc, pdf PDF) string {
+	return fmt.Sprintf(template,
+		html.EscapeString(sp.Name),
+		pdfBaseUrl(pdf.Url),
+		pdf.Url,
+		html.EscapeString(pdf.Name),
+		// pdf.Date,  NOTE: Only sending messages when PDF first appears.
+		//                  To know PDF date, check when the message was sent.
+	)
+}
+
+// pdfBaseUrl returns what is prepended to the pdf url to download it.
+func pdfBaseUrl(pdfUrl string) string {
+	if strings.HasPrefix(pdfUrl, "http://") || strings.HasPrefix(pdfUrl, "https://") {
+		return "" // old registries store absolute urls
+	}
+	return "https://www.aemet.es"
+}
 
-var processingErrorCodeToString = map[ProcessingErrorCode]string{
-	SendMessageError:       "SendMessageError",
-	ReadTemplateError:      "ReadTemplateError",
-	ReadRegistryError:      "ReadRegistryError",
-	WriteRegistryError:     "WriteRegistryError",
-	UnmarshalRegistryError: "UnmarshalRegistryError",
-	MarshalRegistryError:   "MarshalRegistryError",
-	GetUrlContentError:     "GetUrlContentError",
-	BlankPDFDateError:      "BlankPDFDateError",
+// Most flood waits sendPDF honours before giving up.
+const MAX_FLOOD_WAIT = time.Minute
+
+// sendPDF sends the notification of the pdf to the chat. When Telegram asks to
+// slow down, the message is sent again after the time it tells.
+func sendPDF(bot *tele.Bot, botName string, c *ChatConfig, sp *SelectiveProc, template string, pdf PDF) (*tele.Message, error) {
+	message := formatPDFMessage(template, sp, pdf)
+	sent, err := bot.Send(c, message, &tele.SendOptions{ParseMode: "HTML"})
+	observeSend(botName, c.Name, err)
+
+	var flood tele.FloodError
+	if errors.As(err, &flood) && time.Duration(flood.RetryAfter)*time.Second <= MAX_FLOOD_WAIT {
+		slog.Warn("Sending too fast, waiting", LOG_CHAT_KEY, c.Name, "retry_after", flood.RetryAfter)
+		time.Sleep(time.Duration(flood.RetryAfter) * time.Second)
+		sent, err = bot.Send(c, message, &tele.SendOptions{ParseMode: "HTML"})
+		observeSend(botName, c.Name, err)
+	}
+	return sent, err
+}
+
+type procStats struct {
+	PagesFetched int
+	PDFsFound    int
+	NewPDFs      int
+	Errors       int
 }
 
-type processingErrorMessage struct {
-	errCode  ProcessingErrorCode
-	chatName string
-	procName string
-	pdfName  string
-	message  error
+func (s *procStats) Add(other procStats) {
+	s.PagesFetched += other.PagesFetched
+	s.PDFsFound += other.PDFsFound
+	s.NewPDFs += other.NewPDFs
+	s.Errors += other.Errors
 }
 
-func (errMessage *processingErrorMessage) Format() string {
-	format := "Error: <strong>%s</strong>\n" +
-		"  - chat name: <i>%s</i>\n" +
-		"  - proc name: <i>%s</i>\n" +
-		"  - pdf name:  <i>%s</i>\n" +
-		"  - message:   <pre language=\"console\">%s</pre>\n"
+// procResult is what a round did in a selective process of a chat.
+type procResult struct {
+	Chat string
+	Proc string
+	procStats
+}
+
+type roundSummary struct {
+	procStats
+	Procs       int
+	FailedProcs int          // with any error
+	Results     []procResult // by chat and selective process
+	Duration    time.Duration
+}
+
+func (rs *roundSummary) Format() string {
+	format := "Check finished in <b>%s</b>\n" +
+		"  - pages fetched: %d\n" +
+		"  - pdfs found:    %d\n" +
+		"  - new pdfs:      %d\n" +
+		"  - errors:        %d\n"
 
 	return fmt.Sprintf(format,
-		processingErrorCodeToString[errMessage.errCode],
-		errMessage.chatName,
-		errMessage.procName,
-		errMessage.pdfName,
-		errMessage.message,
+		rs.Duration.Round(time.Millisecond),
+		rs.PagesFetched,
+		rs.PDFsFound,
+		rs.NewPDFs,
+		rs.Errors,
 	)
 }
 
-var FilterErrors = false
+// roundOptions tell what a round does with the pdfs new to a chat.
+type roundOptions struct {
+	send   bool      // false only registers them, like init
+	dryRun io.Writer // if set, they are written to it and no registry is changed
+	bot    string    // name of the bot, for the metrics and health checks
+	start  time.Time // when the round started, set by processChats
+}
+
+// Id of the last round, logged to tell the rounds apart.
+var lastRoundId atomic.Uint64
 
-func (errMessage *processingErrorMessage) ToBeFiltered() bool {
-	if !FilterErrors {
-		return false
+func processSelectiveProc(logger *slog.Logger, bot *tele.Bot, c *ChatConfig, sp *SelectiveProc, err_ch chan *ProcessingError, opts roundOptions) procStats {
+	var stats procStats
+
+	logger = logger.With(LOG_CHAT_KEY, c.Name, LOG_PROC_KEY, sp.Name)
+	logger.Info("Processing updates", LOG_URL_KEY, sp.Url)
+	defer func() {
+		if stats.Errors == 0 {
+			health.RoundSucceeded(opts.bot, c.Name, sp.Name, time.Now())
+		}
+	}()
+
+	report := func(errCode ProcessingErrorCode, pdfName string, err error) {
+		stats.Errors++
+		processingErrorsTotal.WithLabelValues(errCode.String()).Inc()
+		pe := newProcessingError(errCode, c, sp, err)
+		pe.PDF = pdfName
+		err_ch <- pe
 	}
 
-	// error filtering policy
-	if errMessage.errCode == GetUrlContentError {
-		return true
+	page, err := pages.Fetch(sp.Url)
+	if err != nil {
+		logger.Error("Could not get url", LOG_URL_KEY, sp.Url, LOG_ERROR_CODE_KEY, GetUrlContentError.String(), "error", err)
+		report(GetUrlContentError, "", err)
+		return stats
 	}
-	return false
-}
+	stats.PagesFetched++
 
-type pdfRegistry map[string]map[string]string
+	template, err := os.ReadFile(sp.TemplatePath)
+	if err != nil {
+		logger.Error("Could not read template", "path", sp.TemplatePath, LOG_ERROR_CODE_KEY, ReadTemplateError.String(), "error", err)
+		report(ReadTemplateError, "", err)
+		return stats
+	}
 
-func processUpdates(bot *tele.Bot, botConfig *BotConfig, err_ch chan processingErrorMessage, send_on bool) {
-	procChat := func(c ChatConfig) {
-		for _, sp := range c.SelectiveProcs {
-			log.Printf("[INFO] Processing updates for chat %s[%s], selective process '%s'\n", c.Name, c.ChatId, sp.Name)
+	// chats sharing the registry take turns to read and write it, each
+	// sending what it misses. It is not held while sending, which may wait
+	// for the flood limits: the deliveries are written before and after.
+	unlock := lockRegistry(sp.RegistryPath)
+
+	var registry *pdfRegistry
+	changed := false // whether the registry has to be written at the end
+	registry_data, err := os.ReadFile(sp.RegistryPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// first round of the registry, e.g. init
+		logger.Info("Registry not found, creating it", "path", sp.RegistryPath)
+		registry = newRegistry(sp.Name, sp.Url)
+		changed = true
+	} else if err != nil {
+		logger.Warn("Could not read registry", "path", sp.RegistryPath, LOG_ERROR_CODE_KEY, ReadRegistryError.String(), "error", err)
+		report(ReadRegistryError, "", err)
+		// file will be created later, so we dont return in this case
+		registry = newRegistry(sp.Name, sp.Url)
+		changed = true
+	} else {
+		var changes []string
+		registry, changes, err = decodeRegistry(registry_data)
+		if err != nil {
+			unlock()
+			logger.Error("Could not parse JSON from registry data", "path", sp.RegistryPath, LOG_ERROR_CODE_KEY, UnmarshalRegistryError.String(), "error", err)
+			report(UnmarshalRegistryError, "", err)
+			return stats
+		}
+		if len(changes) > 0 {
+			logger.Info("Registry upgraded", "path", sp.RegistryPath, "changes", len(changes))
+			changed = true
+		}
+	}
+	if registry.Url != sp.Url || registry.Proc == "" {
+		registry.Url = sp.Url
+		if registry.Proc == "" {
+			registry.Proc = sp.Name
+		}
+		changed = true
+	}
 
-			err_message := processingErrorMessage{
-				chatName: c.Name,
-				procName: sp.Name,
-				pdfName:  "",
-			}
+	// saveRegistry writes the registry, reporting the errors as about pdfName
+	saveRegistry := func(pdfName string) bool {
+		if opts.dryRun != nil {
+			return true
+		}
+		registry_data, err := json.Marshal(registry)
+		if err != nil {
+			logger.Error("Could not JSON encode registry", LOG_PDF_KEY, pdfName, LOG_ERROR_CODE_KEY, MarshalRegistryError.String(), "error", err)
+			report(MarshalRegistryError, pdfName, err)
+			return false
+		}
 
-			var client = &http.Client{}
-			res, err := client.Get(sp.Url)
-			if err != nil {
-				if res != nil { // if err != nil it might be the case that res is nil
-					log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Something went wrong getting url. StatusCode: %d: '%s'\n", c.Name, sp.Name, res.StatusCode, err)
-					res.Body.Close()
-				} else {
-					log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Something went wrong getting url: '%s'", c.Name, sp.Name, err)
-				}
-
-				err_message.errCode = GetUrlContentError
-				err_message.message = err
-				err_ch <- err_message
-				return
-			}
+		err = writeRegistryData(sp.RegistryPath, registry_data)
+		if err != nil {
+			logger.Error("Could not write registry", LOG_PDF_KEY, pdfName, "path", sp.RegistryPath, LOG_ERROR_CODE_KEY, WriteRegistryError.String(), "error", err)
+			report(WriteRegistryError, pdfName, err)
+			return false
+		}
+		return true
+	}
 
-			template, err := os.ReadFile(sp.TemplatePath)
-			if err != nil {
-				log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Could not read teamplate from path '%s'\n", c.Name, sp.Name, sp.TemplatePath)
-				err_message.errCode = ReadTemplateError
-				err_message.message = err
-				err_ch <- err_message
-				res.Body.Close()
-				return
+	roundStart := time.Now().UTC()
+	// chats joining in the same round join at its start, so none of them
+	// takes the pdfs registered by the others this round as old ones
+	joinAt := opts.start
+	if joinAt.IsZero() {
+		joinAt = roundStart
+	}
+	_, joinedBefore := registry.Chats[c.Name]
+	joined := registry.joinChat(c.Name, joinAt)
+	changed = changed || !joinedBefore
+	var toSend []PDF // sent once the registry is released
+	newPDFs := map[string]bool{}
+	pdfs := make(chan PDF)
+	go GenPDFs(bytes.NewReader(page), pdfs) // <- this one closes the channel when finishes
+	for pdf, ok := <-pdfs; ok; pdf, ok = <-pdfs {
+		stats.PDFsFound++
+		pdfsFoundTotal.WithLabelValues(opts.bot, c.Name, sp.Name).Inc()
+		now := time.Now().UTC()
+
+		record, exists := registry.PDFs[pdf.Name]
+		if exists {
+			// LastSeen alone only makes the registry be written once in a
+			// while, not every round
+			if now.Sub(record.LastSeen) >= REGISTRY_LAST_SEEN_PRECISION || !record.RemovedAt.IsZero() {
+				changed = true
+			}
+			record.LastSeen = now
+			record.RemovedAt = time.Time{}
+			if record.Size == 0 && pdf.Size != 0 {
+				record.Size = pdf.Size
+				changed = true
 			}
+			if _, delivered := record.Deliveries[c.Name]; delivered {
+				continue
+			}
+			// registered by another chat: this round, or before this chat used
+			// the registry, which is only sent when backfilling
+			if record.FirstSeen.Before(joined) && !sp.Backfill {
+				record.setDelivery(c.Name, &Delivery{Status: DELIVERY_SKIPPED, At: now})
+				changed = true
+				continue
+			}
+			logger.Info("Registered pdf not sent to chat yet", LOG_PDF_KEY, pdf.Name, "backfill", sp.Backfill)
+		} else {
+			logger.Info("New pdf found", LOG_PDF_KEY, pdf.Name, LOG_URL_KEY, pdf.Url, "date", pdf.Date)
+		}
+		stats.NewPDFs++
+		newPDFsTotal.WithLabelValues(opts.bot, c.Name, sp.Name).Inc()
+		changed = true
+
+		if false { // NOTE: prev condition: pdf.Date == ""
+			//               now all pdfs do not have a date,
+			//               so this no longer makes sense
+			logger.Error("Date not present for pdf", LOG_PDF_KEY, pdf.Name, LOG_ERROR_CODE_KEY, BlankPDFDateError.String())
+			report(BlankPDFDateError, pdf.Name, errors.New("PDF Date is blank. This might be due to a error when parsing it"))
+		}
+
+		if !exists {
+			record = &PDFRecord{Url: pdf.Url, Date: pdf.Date, FirstSeen: now, LastSeen: now, Size: pdf.Size}
+			registry.PDFs[pdf.Name] = record
+			newPDFs[pdf.Name] = true
+		}
+
+		if opts.dryRun != nil {
+			writeDryRun(opts.dryRun, c, sp, string(template), pdf, opts.send)
+			continue
+		}
+		if !opts.send {
+			record.setDelivery(c.Name, &Delivery{Status: DELIVERY_SKIPPED, At: now})
+			continue
+		}
 
-			registry_data, err := os.ReadFile(sp.RegistryPath)
-			var registry = pdfRegistry{}
-			if err != nil {
-				log.Printf("[WARNING] Chat '%s' - Selective process '%s'. Could not read registry from path '%s'\n", c.Name, sp.Name, sp.RegistryPath)
-				err_message.errCode = ReadRegistryError
-				err_message.message = err
-				err_ch <- err_message
-				// file will be created later, so we dont return in this case
+		// the delivery is registered before sending, so the pdf is never sent
+		// twice: if the bot stops before sending it is left as failed
+		record.setDelivery(c.Name, &Delivery{Status: DELIVERY_FAILED, At: now, Error: "not sent, interrupted"})
+		toSend = append(toSend, pdf)
+	} // each pdf
+
+	// an empty page is more likely an error of the site than every pdf removed
+	if stats.PDFsFound > 0 {
+		for name, record := range registry.PDFs {
+			if record.LastSeen.Before(roundStart) && record.RemovedAt.IsZero() {
+				logger.Info("Pdf removed from the page", LOG_PDF_KEY, name)
+				record.RemovedAt = roundStart
+				changed = true
+			}
+		}
+	}
+	if changed && !saveRegistry("") {
+		toSend = nil // nothing is sent unless registered
+	}
+	unlock()
+
+	for _, pdf := range toSend {
+		record := registry.PDFs[pdf.Name]
+		if newPDFs[pdf.Name] {
+			// only new pdfs are downloaded, init would download the whole page
+			if size, hash, err := fetchPDFDigest(pdf.Url); err != nil {
+				logger.Warn("Could not download pdf to hash it", LOG_PDF_KEY, pdf.Name, LOG_URL_KEY, pdf.Url, "error", err)
 			} else {
-				err = json.Unmarshal(registry_data, &registry)
-				if err != nil {
-					log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Could not parse JSON from registry data\n", c.Name, sp.Name)
-					err_message.errCode = UnmarshalRegistryError
-					err_message.message = err
-					err_ch <- err_message
-					res.Body.Close()
-					return
-				}
+				record.Size, record.Hash = size, hash
 			}
+		}
+
+		sent, err := sendPDF(bot, opts.bot, c, sp, string(template), pdf)
+		if err != nil {
+			logger.Error("Could not send message to chat", LOG_PDF_KEY, pdf.Name, LOG_ERROR_CODE_KEY, SendMessageError.String(), "error", err)
+			report(SendMessageError, pdf.Name, err)
+			record.setDelivery(c.Name, &Delivery{Status: DELIVERY_FAILED, At: time.Now().UTC(), Error: err.Error()})
+			continue
+		}
+		record.setDelivery(c.Name, &Delivery{Status: DELIVERY_SENT, At: time.Now().UTC(), MessageId: sent.ID})
+	}
 
-			pdfs := make(chan PDF)
-			go GenPDFs(res.Body, pdfs) // <- this one closes the channel when finishes
-			for pdf, ok := <-pdfs; ok; pdf, ok = <-pdfs {
-				if _, exists := registry[pdf.Name]; !exists {
-					log.Printf("[INFO] Chat '%s' - Selective process '%s'. New pdf found: '%+v'\n", c.Name, sp.Name, pdf)
-
-					if false { // NOTE: prev condition: pdf.Date == ""
-						//               now all pdfs do not have a date,
-						//               so this no longer makes sense
-						log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Date not present for pdf '%s'\n", c.Name, sp.Name, pdf.Name)
-						err_message.errCode = BlankPDFDateError
-						err_message.pdfName = pdf.Name
-						err_message.message = errors.New("PDF Date is blank. This might be due to a error when parsing it")
-						err_ch <- err_message
-					}
-
-					registry[pdf.Name] = map[string]string{"pdf_url": pdf.Url, "pdf_date": pdf.Date}
-
-					registry_data, err = json.Marshal(registry)
-					if err != nil {
-						log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Could not JSON encode registry\n", c.Name, sp.Name)
-						err_message.errCode = MarshalRegistryError
-						err_message.pdfName = pdf.Name
-						err_message.message = err
-						err_ch <- err_message
-						continue
-					}
-
-					err = os.WriteFile(sp.RegistryPath, registry_data, 0664)
-					if err != nil {
-						log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Could not write registry to file '%s'\n", c.Name, sp.Name, sp.RegistryPath)
-						err_message.errCode = WriteRegistryError
-						err_message.pdfName = pdf.Name
-						err_message.message = err
-						err_ch <- err_message
-						continue
-					}
-
-					if send_on {
-						message := fmt.Sprintf(string(template),
-							sp.Name,
-							"https://www.aemet.es",
-							pdf.Url,
-							pdf.Name,
-							// pdf.Date,  NOTE: Only sending messages when PDF first appears.
-							//                  To know PDF date, check when the message was sent.
-						)
-						if _, err := bot.Send(&c, message, &tele.SendOptions{ParseMode: "HTML"}); err != nil {
-							log.Printf("[ERROR] Chat '%s' - Selective process '%s'. Could not send message to chat%s\n", c.Name, sp.Name, err)
-							err_message.errCode = SendMessageError
-							err_message.pdfName = pdf.Name
-							err_message.message = err
-							err_ch <- err_message
-							continue
-						}
-					}
-				} // if pdf !exists
-			} // each pdf
-			res.Body.Close()
+	if len(toSend) > 0 {
+		// other chats may have written the registry meanwhile
+		defer lockRegistry(sp.RegistryPath)()
+		sending := registry
+		if registry, err = readRegistry(sp.RegistryPath); err != nil {
+			logger.Warn("Could not read registry again, writing the one read before", "path", sp.RegistryPath, LOG_ERROR_CODE_KEY, ReadRegistryError.String(), "error", err)
+			report(ReadRegistryError, "", err)
+			registry = sending
+		}
+		for _, pdf := range toSend {
+			sent := sending.PDFs[pdf.Name]
+			record, ok := registry.PDFs[pdf.Name]
+			if !ok {
+				registry.PDFs[pdf.Name] = sent
+				continue
+			}
+			record.setDelivery(c.Name, sent.Deliveries[c.Name])
+			if record.Hash == "" && sent.Hash != "" {
+				record.Size, record.Hash = sent.Size, sent.Hash
+			}
+		}
+		saveRegistry("")
+	}
+	registryEntries.WithLabelValues(opts.bot, c.Name, sp.Name).Set(float64(len(registry.PDFs)))
+
+	return stats
+}
+
+// processChats runs a round over the given chats and waits for it to finish.
+// Chats are processed concurrently and their selective processes in order.
+// Only the selective processes sharing a registry wait for each other, so the
+// rounds of other bots and /check go on.
+func processChats(bot *tele.Bot, chats []ChatConfig, err_ch chan *ProcessingError, opts roundOptions) roundSummary {
+	var summary roundSummary
+	start := time.Now()
+	logger := slog.With(LOG_ROUND_ID_KEY, lastRoundId.Add(1))
+	opts.start = start.UTC()
+
+	var wg sync.WaitGroup
+	var statsMu sync.Mutex
+	procChat := func(c ChatConfig) {
+		defer wg.Done()
+		for _, sp := range c.SelectiveProcs {
+			stats := processSelectiveProc(logger, bot, &c, &sp, err_ch, opts)
+			statsMu.Lock()
+			summary.Add(stats)
+			summary.Procs++
+			if stats.Errors > 0 {
+				summary.FailedProcs++
+			}
+			summary.Results = append(summary.Results, procResult{c.Name, sp.Name, stats})
+			statsMu.Unlock()
 		} // each sp
 	} // procChat
-	for _, c := range botConfig.ChatConfigs {
+	for _, c := range chats {
+		wg.Add(1)
 		go procChat(c)
 	}
+	wg.Wait()
+
+	sort.Slice(summary.Results, func(i, j int) bool {
+		if summary.Results[i].Chat != summary.Results[j].Chat {
+			return summary.Results[i].Chat < summary.Results[j].Chat
+		}
+		return summary.Results[i].Proc < summary.Results[j].Proc
+	})
+	summary.Duration = time.Since(start)
+	return summary
+}
+
+func processUpdates(bot *tele.Bot, botConfig *BotConfig, err_ch chan *ProcessingError, opts roundOptions) roundSummary {
+	opts.bot = botConfig.Name
+	summary := processChats(bot, botConfig.ChatConfigs, err_ch, opts)
+	observeRound(botConfig.Name, summary)
+	return summary
+}
+
+// selectChats returns the chats named chatName, every chat if empty, with
+// only their selective processes named procName, all if empty. Chats left
+// without selective processes are dropped.
+func selectChats(chats []ChatConfig, chatName, procName string) []ChatConfig {
+	var selected []ChatConfig
+	for _, c := range chats {
+		if chatName != "" && !strings.EqualFold(c.Name, chatName) {
+			continue
+		}
+		if procName == "" {
+			selected = append(selected, c)
+			continue
+		}
+		if i := c.findProc(procName); i >= 0 {
+			chat := c
+			chat.SelectiveProcs = []SelectiveProc{c.SelectiveProcs[i]}
+			selected = append(selected, chat)
+		}
+	}
+	return selected
 }
 
-func is_admin_chat(c *tele.Context, bc *BotConfig) bool {
-	if bc.ChatAdminConfig == nil {
-		log.Println("[WARNING] Admin chat not configured")
-		return false
+// filterChats returns the chats whose name is name or, if there is none, the
+// chats having a selective process named name, keeping only that process.
+func filterChats(chats []ChatConfig, name string) []ChatConfig {
+	for _, c := range chats {
+		if strings.EqualFold(c.Name, name) {
+			return []ChatConfig{c}
+		}
 	}
 
-	chat := (*c).Chat()
-	if chat == nil {
-		log.Println("[WARNING] Chat not present in Context")
-		return false
+	var filtered []ChatConfig
+	for _, c := range chats {
+		for _, sp := range c.SelectiveProcs {
+			if strings.EqualFold(sp.Name, name) {
+				chat := c
+				chat.SelectiveProcs = []SelectiveProc{sp}
+				filtered = append(filtered, chat)
+				break
+			}
+		}
 	}
+	return filtered
+}
 
-	return strconv.FormatInt(chat.ID, 10) == bc.ChatAdminConfig.ChatId
+// sendToAdmins sends the message to every admin chat, if any.
+func sendToAdmins(bot *tele.Bot, bc *BotConfig, message string) {
+	for _, admin := range bc.allAdminChats() {
+		if _, err := bot.Send(admin, message, &tele.SendOptions{ParseMode: "HTML"}); err != nil {
+			slog.Error("Could not send message to admin chat", LOG_CHAT_KEY, admin.Name, "error", err)
+		}
+	}
 }
 
 var commands = []tele.Command{
@@ -220,25 +462,42 @@ var commands = []tele.Command{
 	{Text: "/pause", Description: "Pause the bot"},
 	{Text: "/play", Description: "Restart bot if paused"},
 	{Text: "/state", Description: "Current bot state (running/paused)"},
-	{Text: "/switch_errors", Description: "Activate/Deactivate errors filtering"},
+	{Text: "/check", Description: "Check for new documents now: /check [chat|proc]"},
+	{Text: "/proc_list", Description: "List selective processes: /proc_list [chat]"},
+	{Text: "/proc_add", Description: "Add a selective process: /proc_add <chat> <name> <url> [init|backfill]"},
+	{Text: "/proc_rm", Description: "Remove a selective process: /proc_rm <chat> <name>"},
+	{Text: "/proc_set_template", Description: "Change a template: /proc_set_template <chat> <name> <path>"},
+	{Text: "/reload", Description: "Reload the configuration file"},
+	{Text: "/latest", Description: "Latest documents of a selective process: /latest <proc> [n]"},
+	{Text: "/search", Description: "Search documents by name: /search <text>"},
+	{Text: "/errors", Description: "Error severities and mutes"},
+	{Text: "/mute", Description: "Mute errors: /mute <code|all> <duration> [chat [proc]]"},
+	{Text: "/unmute", Description: "Unmute errors: /unmute <code|all> [chat [proc]]"},
+	{Text: "/severity", Description: "Set the severity of an error: /severity <code> <severity>"},
+	{Text: "/min_severity", Description: "Minimum severity of the errors sent: /min_severity <severity>"},
 }
 
-func usage_commands() string {
-	usage := "Commands:\n"
-	for _, c := range commands {
-		usage += fmt.Sprintf("<code>%s</code>  %s\n", c.Text, c.Description)
-	}
-
-	return usage
+// How often the scheduler checks whether a bot is due for a new round.
+const SCHEDULER_TICK = time.Second
+
+// botInstance is one bot run by the process, with its own token, chats and
+// selective processes.
+type botInstance struct {
+	bot       *tele.Bot
+	lc        *liveConfig
+	paused    atomic.Bool
+	running   atomic.Bool // a round, scheduled or from /check, is running
+	errCh     chan *ProcessingError
+	errors    *errorAggregator
+	nextRound time.Time
 }
 
-func handle_run_command(configPath string) {
-	var botConfig BotConfig
-	botConfig.SetUp(configPath)
-
+// newTeleBot connects to Telegram with the bot token. Updates are not polled
+// until the bot is started.
+func newTeleBot(bc *BotConfig) (*tele.Bot, error) {
 	sett := tele.Settings{
-		Token:  botConfig.Token,
-		Poller: &tele.LongPoller{Timeout: botConfig.TimeInterval},
+		Token:  bc.Token,
+		Poller: &tele.LongPoller{Timeout: bc.TimeInterval.Duration()},
 		Client: &http.Client{
 			Transport: &http.Transport{
 				Proxy: http.ProxyFromEnvironment,
@@ -249,207 +508,265 @@ func handle_run_command(configPath string) {
 
 	bot, err := tele.NewBot(sett)
 	if err != nil {
-		log.Fatalf("[ERROR] Could not instantiate bot: %s\n", err)
-		return
+		slog.Error("Could not instantiate bot", "bot", bc.Name, "error", err)
+		return nil, err
 	}
+	return bot, nil
+}
+
+func newBotInstance(configPath string, botConfig BotConfig) (*botInstance, error) {
+	bot, err := newTeleBot(&botConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &botInstance{
+		bot:    bot,
+		lc:     newLiveConfig(configPath, botConfig),
+		errCh:  make(chan *ProcessingError, 50),
+		errors: newErrorAggregator(),
+	}
+	b.registerHandlers()
+	return b, nil
+}
+
+func (b *botInstance) registerHandlers() {
+	bot, lc := b.bot, b.lc
+
+	bot.Use(requireRoles(lc, &auditLog{}))
 
 	bot.Handle("/help", func(c tele.Context) error {
-		if is_admin_chat(&c, &botConfig) {
-			err = c.Send(usage_commands(), &tele.SendOptions{ParseMode: "HTML"})
-			if err != nil {
-				log.Println("[ERROR] Could not send response for /help command")
-			}
-			return err
+		err := c.Send(usageFor(roleOf(c, lc.Get())), &tele.SendOptions{ParseMode: "HTML"})
+		if err != nil {
+			slog.Error("Could not send response", "command", "/help", "error", err)
 		}
-		return nil
+		return err
 	})
 
-	paused := false
 	bot.Handle("/pause", func(c tele.Context) error {
-		if is_admin_chat(&c, &botConfig) {
-			paused = true
-		}
+		b.paused.Store(true)
+		observePaused(lc.Get().Name, true)
 		return nil
 	})
 
 	bot.Handle("/play", func(c tele.Context) error {
-		if is_admin_chat(&c, &botConfig) {
-			paused = false
-		}
+		b.paused.Store(false)
+		observePaused(lc.Get().Name, false)
 		return nil
 	})
 
 	bot.Handle("/state", func(c tele.Context) error {
-		if is_admin_chat(&c, &botConfig) {
-			var msg string
-			if paused {
-				msg = fmt.Sprintf("I'm paused... &#x%s;", "1F6C0") // unicode symbol: bath
-			} else {
-				msg = fmt.Sprintf("I'm running... &#x%s;", "1F3C3") // unicode symbol: person running
-			}
+		var msg string
+		if b.paused.Load() {
+			msg = fmt.Sprintf("I'm paused... &#x%s;", "1F6C0") // unicode symbol: bath
+		} else {
+			msg = fmt.Sprintf("I'm running... &#x%s;", "1F3C3") // unicode symbol: person running
+		}
 
-			err = c.Send(msg, &tele.SendOptions{ParseMode: "HTML"})
-			if err != nil {
-				log.Println("[ERROR] Could not send response for /state command")
-			}
-			return err
+		err := c.Send(msg, &tele.SendOptions{ParseMode: "HTML"})
+		if err != nil {
+			slog.Error("Could not send response", "command", "/state", "error", err)
 		}
-		return nil
+		return err
 	})
 
-	bot.Handle("/switch_errors", func(c tele.Context) error {
-		if is_admin_chat(&c, &botConfig) {
-			FilterErrors = !FilterErrors
-			var msg string
-			if FilterErrors {
-				msg = "Filtering activated"
-			} else {
-				msg = "Filtering deactivated"
+	bot.Handle("/check", func(c tele.Context) error {
+		chats := lc.Get().ChatConfigs
+		if args := c.Args(); len(args) > 0 {
+			if chats = filterChats(chats, args[0]); len(chats) == 0 {
+				return c.Send(fmt.Sprintf("Unknown chat or selective process '%s'", html.EscapeString(args[0])), &tele.SendOptions{ParseMode: "HTML"})
 			}
-			err = c.Send(msg, &tele.SendOptions{ParseMode: "HTML"})
-			if err != nil {
-				log.Println("[ERROR] Could not send response for /switch_errors command")
-			}
-			return err
 		}
-		return nil
+
+		if !b.running.CompareAndSwap(false, true) {
+			return c.Send("A round is already running, try again when it finishes")
+		}
+		defer b.running.Store(false)
+
+		slog.Info("Check requested", "bot", lc.Get().Name)
+		summary := processChats(bot, chats, b.errCh, roundOptions{send: true, bot: lc.Get().Name})
+		err := c.Send(summary.Format(), &tele.SendOptions{ParseMode: "HTML"})
+		if err != nil {
+			slog.Error("Could not send response", "command", "/check", "error", err)
+		}
+		return err
+	})
+
+	bot.Handle("/reload", func(c tele.Context) error {
+		err := c.Send(reloadConfig(bot, lc, "/reload command"), &tele.SendOptions{ParseMode: "HTML"})
+		if err != nil {
+			slog.Error("Could not send response", "command", "/reload", "error", err)
+		}
+		return err
 	})
 
-	go bot.Start()
+	registerProcHandlers(bot, lc, b.errCh)
+	registerQueryHandlers(bot, lc)
+	registerErrorHandlers(bot, lc)
+}
 
-	err_chan := make(chan processingErrorMessage, 50)
+// tick delivers the pending errors, aggregated, to the admin chats and error
+// sinks and starts a new round if one is due. Errors are delivered even while
+// the bot is paused, so the rounds sending them never block.
+func (b *botInstance) tick(now time.Time) {
+	botConfig := b.lc.Get()
+pending:
 	for {
-		if !paused {
-			select {
-			case errMessageData := <-err_chan:
-				if botConfig.ChatAdminConfig != nil {
-					if !errMessageData.ToBeFiltered() {
-						errMessage := errMessageData.Format()
-						if _, err := bot.Send(botConfig.ChatAdminConfig, errMessage, &tele.SendOptions{ParseMode: "HTML"}); err != nil {
-							log.Printf("[ERROR] Could not send error message to admin chat: %s\n", err)
-						}
-					}
-				}
-			default:
-				log.Println("[INFO] New round!")
-				go processUpdates(bot, &botConfig, err_chan, true)
-				time.Sleep(botConfig.TimeInterval)
+		select {
+		case pe := <-b.errCh:
+			if alert, ok := b.errors.Add(pe, now); ok {
+				deliverAlert(b.bot, botConfig, alert, now)
 			}
-		} else {
-			time.Sleep(2 * time.Second)
+		default:
+			break pending
 		}
 	}
+	for _, alert := range b.errors.Flush(now, botConfig.errorWindow(), botConfig.errorResolveAfter()) {
+		deliverAlert(b.bot, botConfig, alert, now)
+	}
+
+	if b.paused.Load() || now.Before(b.nextRound) {
+		return
+	}
+	b.nextRound = now.Add(botConfig.TimeInterval.Duration())
+	if !b.running.CompareAndSwap(false, true) {
+		slog.Warn("Round skipped, the previous one is still running", "bot", botConfig.Name)
+		return
+	}
+
+	slog.Info("New round", "bot", botConfig.Name)
+	go func() {
+		defer b.running.Store(false)
+		processUpdates(b.bot, botConfig, b.errCh, roundOptions{send: true})
+	}()
 }
 
-func handle_init_command(configPath string) {
-	var botConfig BotConfig
-	botConfig.SetUp(configPath)
+// runBots runs every bot with a single scheduler. Pages watched by several
+// bots are fetched once per round.
+func runBots(instances []*botInstance) {
+	ttl := time.Duration(0)
+	for _, b := range instances {
+		if interval := b.lc.Get().TimeInterval.Duration(); ttl == 0 || interval/2 < ttl {
+			ttl = interval / 2
+		}
+	}
+	pages = newPageCache(ttl)
+
+	addrs := map[string]bool{}
+	for _, b := range instances {
+		botConfig := b.lc.Get()
+		observePaused(botConfig.Name, false)
+		if addr := botConfig.MetricsAddress; addr != "" && !addrs[addr] {
+			addrs[addr] = true
+			go serveStatus(addr, instances)
+		}
 
-	sett := tele.Settings{
-		Token:  botConfig.Token,
-		Poller: &tele.LongPoller{Timeout: botConfig.TimeInterval},
-		Client: &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyFromEnvironment,
-			},
-			Timeout: 10 * time.Second,
-		},
+		go b.bot.Start()
+		go watchConfig(b.bot, b.lc)
 	}
 
-	bot, err := tele.NewBot(sett)
+	for {
+		now := time.Now()
+		health.Tick(now)
+		for _, b := range instances {
+			b.tick(now)
+		}
+		time.Sleep(SCHEDULER_TICK)
+	}
+}
+
+func handle_run_command(configPaths []string) {
+	configs := make([]BotConfig, len(configPaths))
+	loadErrs := make([]error, len(configPaths))
+	for i, path := range configPaths {
+		configs[i], loadErrs[i] = loadConfig(path)
+	}
+
+	// logging is set up first so the problems below reach the log file too.
+	// An invalid first configuration leaves the default logger.
+	logFile, err := setupLogging(configs[0].Log)
 	if err != nil {
-		log.Fatalf("Could not instantiate bot: %s\n", err)
-		return
+		slog.Error("Could not set up logging", "error", err)
+		os.Exit(-1)
 	}
+	defer logFile.Close()
 
-	go bot.Start()
+	invalid := false
+	for _, err := range loadErrs {
+		if err != nil {
+			slog.Error("Invalid bot configuration", "problems", err.Error())
+			invalid = true
+		}
+	}
+	if invalid {
+		os.Exit(-1)
+	}
 
-	log.Println("[INFO] Starting initialisation.")
-	err_chan := make(chan processingErrorMessage, 50)
-	all_processed := false
-	for {
-		select {
-		case errMessageData := <-err_chan:
-			if botConfig.ChatAdminConfig != nil {
+	if err := checkBots(configPaths, configs); err != nil {
+		slog.Error("Invalid bot configurations", "problems", err.Error())
+		os.Exit(-1)
+	}
 
-				errMessage := errMessageData.Format()
-				if _, err := bot.Send(botConfig.ChatAdminConfig, errMessage, &tele.SendOptions{ParseMode: "HTML"}); err != nil {
-					log.Printf("[ERROR] Could not send error message to admin chat: %s\n", err)
-				}
-			}
-		default:
-			if !all_processed {
-				go processUpdates(bot, &botConfig, err_chan, false)
-				all_processed = true
-				time.Sleep(botConfig.TimeInterval * 2)
-			} else {
-				log.Println("[INFO] Registries initialised!")
-				return
-			}
+	var instances []*botInstance
+	for i, path := range configPaths {
+		b, err := newBotInstance(path, configs[i])
+		if err != nil {
+			os.Exit(-1)
 		}
+		instances = append(instances, b)
 	}
-}
 
-func usage() {
-	fmt.Println(
-		"usage: ./aemet_tg_bot <command> [--bot-config=<config-path>]\n\n" +
-			"commands:\n" +
-			"    help                                 Print this help.\n" +
-			"    run    --bot-config=<config-path>    Start running the bot.\n" +
-			"    init   --bot-config=<config-path>    Initialise the registries by running the bot.\n" +
-			"                                         Only the error messages to admin chat, if\n" +
-			"                                         configured, will be sent.")
+	runBots(instances)
 }
 
-func nextFlagValue(command, flag string, args []string) string {
-	if !strings.HasPrefix(args[0], flag) {
-		usage()
-		fmt.Printf("[ERROR] Unknown flag '%s' for command '%s'\n", args[0], command)
+// handle_init_command registers the pdfs in the pages of the selected
+// selective processes without sending them, so only the pdfs published
+// afterwards are sent. It waits for every selective process to finish.
+func handle_init_command(configPath, chatName, procName string) {
+	var botConfig BotConfig
+	if err := botConfig.SetUp(configPath); err != nil {
 		os.Exit(-1)
 	}
 
-	flag_split := strings.SplitN(args[0], "=", 2)
-	if len(flag_split) < 2 {
-		usage()
-		fmt.Printf("[ERROR] Missing value for flag '%s' in '%s' command\n", flag, command)
-		os.Exit(-1)
+	chats := selectChats(botConfig.ChatConfigs, chatName, procName)
+	if len(chats) == 0 {
+		exitf(-1, "No selective process matches --chat='%s' --proc='%s'", chatName, procName)
 	}
 
-	return flag_split[1]
-}
+	logFile, err := setupLogging(botConfig.Log)
+	if err != nil {
+		slog.Error("Could not set up logging", "error", err)
+		os.Exit(-1)
+	}
+	defer logFile.Close()
 
-func main() {
-	if len(os.Args) <= 1 {
-		usage()
-		fmt.Println("[ERROR] No command provided")
+	bot, err := newTeleBot(&botConfig)
+	if err != nil {
 		os.Exit(-1)
 	}
 
-	switch command := os.Args[1]; command {
-	case "help":
-		usage()
-		return
-	case "run":
-		flag := "--bot-config"
-		if len(os.Args) <= 2 {
-			usage()
-			fmt.Printf("[ERROR] You need to pass the flag '%s' with command '%s'\n", flag, command)
-			os.Exit(-1)
-		}
-		configPath := nextFlagValue(command, flag, os.Args[2:])
-		handle_run_command(configPath)
-	case "init":
-		flag := "--bot-config"
-		if len(os.Args) <= 2 {
-			usage()
-			fmt.Printf("[ERROR] You need to pass the flag '%s' with command '%s'\n", flag, command)
-			os.Exit(-1)
+	slog.Info("Starting initialisation")
+	summary := runOnce(bot, &botConfig, chats, roundOptions{})
+	for _, r := range summary.Results {
+		status := "ok"
+		if r.Errors > 0 {
+			status = fmt.Sprintf("%d errors", r.Errors)
 		}
-		configPath := nextFlagValue(command, flag, os.Args[2:])
-		handle_init_command(configPath)
-	default:
-		usage()
-		fmt.Printf("[ERROR] Unknown command '%s'\n", command)
-		os.Exit(-1)
+		fmt.Printf("%s/%s\t%d pdfs registered, %d found\t%s\n", r.Chat, r.Proc, r.NewPDFs, r.PDFsFound, status)
 	}
+
+	if summary.FailedProcs > 0 {
+		logFile.Close()
+		exitf(-1, "%d of %d registries could not be initialised, run init again for them", summary.FailedProcs, summary.Procs)
+	}
+	slog.Info("Registries initialised", "procs", summary.Procs, "duration", summary.Duration.Round(time.Millisecond))
+}
+
+func handle_validate_command(configPath string) {
+	if _, err := loadConfig(configPath); err != nil {
+		fmt.Println(err)
+		exitf(-1, "Invalid bot configuration")
+	}
+
+	fmt.Println("[INFO] Bot configuration is valid")
 }
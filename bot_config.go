@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"os"
+	"reflect"
 	"time"
 )
 
@@ -13,7 +15,8 @@ var DEFAULT_DATE = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
 // main structs. The herarchy is:
 // botConfig
 //   |_ ...
-//   |_ ChatAdminConfig
+//   |_ ChatAdminConfig (optional)
+//   |_ []ChatAdminConfig (AdminChats, optional)
 //   |_ []ChatConfig
 //     |_ ...
 //     |_ []SelectiveProc
@@ -21,8 +24,9 @@ var DEFAULT_DATE = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
 type SelectiveProc struct {
 	Name         string
 	TemplatePath string
-	RegistryPath string
+	RegistryPath string // shared by the chats watching the same Url
 	Url          string
+	Backfill     bool `json:",omitempty"` // send the pdfs registered before the chat used the registry
 }
 
 type ChatConfig struct {
@@ -44,44 +48,147 @@ func (c *ChatAdminConfig) Recipient() string {
 	return c.ChatId
 }
 
+// allAdminChats returns ChatAdminConfig, if set, followed by AdminChats.
+func (bc *BotConfig) allAdminChats() []*ChatAdminConfig {
+	var admins []*ChatAdminConfig
+	if bc.ChatAdminConfig != nil {
+		admins = append(admins, bc.ChatAdminConfig)
+	}
+	for i := range bc.AdminChats {
+		admins = append(admins, &bc.AdminChats[i])
+	}
+	return admins
+}
+
 type BotConfig struct {
 	Token           string
 	Name            string
-	TimeInterval    time.Duration
-	ChatAdminConfig *ChatAdminConfig
+	TimeInterval    Duration
+	EnvFile         string            `json:",omitempty"`
+	ChatAdminConfig *ChatAdminConfig  // optional
+	AdminChats      []ChatAdminConfig `json:",omitempty"` // more admin chats
+	AdminUserIds    []string          `json:",omitempty"` // users that are admins in any chat
+	Roles           []RoleBinding     `json:",omitempty"` // finer grained access to commands
+	AuditLogPath    string            `json:",omitempty"` // JSON lines file of the commands run
+	MetricsAddress  string            `json:",omitempty"` // e.g. ":9090", serves Prometheus metrics and health checks
+	Health          *HealthConfig     `json:",omitempty"` // optional health thresholds
+	Log             *LogConfig        `json:",omitempty"` // optional, logs as text to stderr by default
+	Errors          *ErrorsConfig     `json:",omitempty"` // optional error aggregation settings
 	ChatConfigs     []ChatConfig
+
+	rawStrings   map[string]rawString // strings with ${VAR} references, by field
+	secretFields map[string]bool      // fields loadSecrets filled, keyed like rawStrings
 }
 
-func loadEnvVars(bc *BotConfig) error {
-	envVar := fmt.Sprintf("BOT_TOKEN_%s", bc.Name)
-	if token, ok := os.LookupEnv(envVar); !ok {
-		return fmt.Errorf("[ERROR] Environment variable '%s' is unset", envVar)
-	} else {
-		bc.Token = token
+// loadSecrets fills the token and chat ids not given in the config from the
+// secrets named after the bot and chat names: BOT_TOKEN_<bot-name> and
+// <bot-name>_CHAT_ID_<chat-name>. Every missing secret is reported in the
+// returned *configProblems error.
+//
+// The fields filled are recorded, so WriteFile blanks them and keeps those
+// given in the config.
+func loadSecrets(bc *BotConfig, secrets *secretResolver) error {
+	var problems configProblems
+	bc.secretFields = map[string]bool{}
+	lookup := func(dst *string, name, field, key string) {
+		secrets.lookupInto(dst, name, field, &problems)
+		if *dst != "" {
+			bc.secretFields[key] = true
+		}
+	}
+
+	if bc.Token == "" {
+		lookup(&bc.Token, fmt.Sprintf("BOT_TOKEN_%s", bc.Name), "Token", "Token")
 	}
 
-	envVar = fmt.Sprintf("%s_CHAT_ID_%s", bc.Name, bc.ChatAdminConfig.Name)
-	if chatId, ok := os.LookupEnv(envVar); !ok {
-		return fmt.Errorf("[ERROR] Environment variable '%s' is unset", envVar)
-	} else {
-		bc.ChatAdminConfig.ChatId = chatId
+	if bc.ChatAdminConfig != nil && bc.ChatAdminConfig.ChatId == "" {
+		envVar := fmt.Sprintf("%s_CHAT_ID_%s", bc.Name, bc.ChatAdminConfig.Name)
+		lookup(&bc.ChatAdminConfig.ChatId, envVar, "ChatAdminConfig.ChatId", "ChatAdminConfig.ChatId")
+	}
+
+	for i := range len(bc.AdminChats) {
+		if bc.AdminChats[i].ChatId == "" {
+			envVar := fmt.Sprintf("%s_CHAT_ID_%s", bc.Name, bc.AdminChats[i].Name)
+			lookup(&bc.AdminChats[i].ChatId, envVar, fmt.Sprintf("AdminChats[%d].ChatId", i), fmt.Sprintf("AdminChats[%q].ChatId", bc.AdminChats[i].Name))
+		}
 	}
 
 	for i := range len(bc.ChatConfigs) {
-		envVar = fmt.Sprintf("%s_CHAT_ID_%s", bc.Name, bc.ChatConfigs[i].Name)
-		if chatId, ok := os.LookupEnv(envVar); !ok {
-			return fmt.Errorf("[ERROR] Environment variable '%s' is unset", envVar)
-		} else {
-			bc.ChatConfigs[i].ChatId = chatId
+		if bc.ChatConfigs[i].ChatId == "" {
+			envVar := fmt.Sprintf("%s_CHAT_ID_%s", bc.Name, bc.ChatConfigs[i].Name)
+			lookup(&bc.ChatConfigs[i].ChatId, envVar, fmt.Sprintf("ChatConfigs[%d].ChatId", i), fmt.Sprintf("ChatConfigs[%q].ChatId", bc.ChatConfigs[i].Name))
 		}
 	}
 
-	return nil
+	return problems.Err()
+}
+
+// Clone returns a deep copy of the configuration, so it can be modified
+// without affecting bc.
+func (bc *BotConfig) Clone() BotConfig {
+	clone := *bc
+
+	if bc.ChatAdminConfig != nil {
+		admin := *bc.ChatAdminConfig
+		clone.ChatAdminConfig = &admin
+	}
+	if bc.Health != nil {
+		thresholds := *bc.Health
+		clone.Health = &thresholds
+	}
+	if bc.Log != nil {
+		logConfig := *bc.Log
+		clone.Log = &logConfig
+	}
+	if bc.Errors != nil {
+		errorsConfig := *bc.Errors
+		errorsConfig.Severities = maps.Clone(bc.Errors.Severities)
+		errorsConfig.Mutes = append([]MuteRule(nil), bc.Errors.Mutes...)
+		errorsConfig.Sinks = nil
+		for _, sc := range bc.Errors.Sinks {
+			errorsConfig.Sinks = append(errorsConfig.Sinks, sc.clone())
+		}
+		clone.Errors = &errorsConfig
+	}
+	clone.AdminChats = append([]ChatAdminConfig(nil), bc.AdminChats...)
+	clone.AdminUserIds = append([]string(nil), bc.AdminUserIds...)
+
+	clone.Roles = nil
+	for _, r := range bc.Roles {
+		r.UserIds = append([]string(nil), r.UserIds...)
+		r.Chats = append([]string(nil), r.Chats...)
+		clone.Roles = append(clone.Roles, r)
+	}
+
+	clone.ChatConfigs = make([]ChatConfig, len(bc.ChatConfigs))
+	for i, c := range bc.ChatConfigs {
+		c.SelectiveProcs = append([]SelectiveProc(nil), c.SelectiveProcs...)
+		clone.ChatConfigs[i] = c
+	}
+
+	return clone
 }
 
+// obfuscate blanks the token and chat ids read from secrets. Configs not set
+// up by loadSecrets, which do not tell, get all of them blanked.
 func obfuscate(bc *BotConfig) {
+	if bc.secretFields != nil {
+		walkStrings(reflect.ValueOf(bc), "", "", func(s *string, field, key string) {
+			if bc.secretFields[key] {
+				*s = ""
+			}
+		})
+		return
+	}
+
 	bc.Token = ""
-	bc.ChatAdminConfig.ChatId = ""
+	if bc.ChatAdminConfig != nil {
+		bc.ChatAdminConfig.ChatId = ""
+	}
+
+	for i := range len(bc.AdminChats) {
+		bc.AdminChats[i].ChatId = ""
+	}
 
 	for i := range len(bc.ChatConfigs) {
 		bc.ChatConfigs[i].ChatId = ""
@@ -89,16 +196,19 @@ func obfuscate(bc *BotConfig) {
 }
 
 func (bc BotConfig) WriteFile(path string) error {
+	bc = bc.Clone() // obfuscate must not touch the caller's chats and admin
 	obfuscate(&bc)
+	restoreSecretRefs(&bc)
 
-	bc_data, err := json.MarshalIndent(bc, "", "    ")
+	// the file is written in the same format it was read, picked by extension
+	bc_data, err := marshalConfig(&bc, configFormatOf(path))
 	if err != nil {
-		log.Printf("[ERROR] Bot Configuration could not be JSON-encoded: %s\n", err)
+		slog.Error("Could not encode bot configuration", "error", err)
 		return err
 	}
 
 	if err = os.WriteFile(path, bc_data, 0664); err != nil {
-		log.Printf("[ERROR] Could not write Bot Configuration to file '%s': %s\n", path, err)
+		slog.Error("Could not write bot configuration", "path", path, "error", err)
 		return err
 	}
 
@@ -108,28 +218,31 @@ func (bc BotConfig) WriteFile(path string) error {
 func (bc *BotConfig) ReadFile(path string) error {
 	bc_data, err := os.ReadFile(path)
 	if err != nil {
-		log.Printf("[ERROR] Could not read Bot Configuration from file '%s': %s\n", path, err)
+		slog.Error("Could not read bot configuration", "path", path, "error", err)
 		return err
 	}
 
-	if err = json.Unmarshal(bc_data, bc); err != nil {
-		log.Printf("[ERROR] Could not JSON-decode Bot Configuration: %s\n", err)
+	bc_data, err = configToJSON(bc_data, configFormatOf(path))
+	if err == nil {
+		err = json.Unmarshal(bc_data, bc)
+	}
+	if err != nil {
+		slog.Error("Could not decode bot configuration", "path", path, "error", err)
 		return err
 	}
 
 	return nil
 }
 
+// SetUp loads and validates the configuration at path. Every problem found is
+// logged and returned together.
 func (bc *BotConfig) SetUp(path string) error {
-	if err := bc.ReadFile(path); err != nil {
-		log.Println("[ERROR] Could not read bot configuration from file")
+	loaded, err := loadConfig(path)
+	if err != nil {
+		slog.Error("Invalid bot configuration", "problems", err.Error())
 		return err
 	}
 
-	if err := loadEnvVars(bc); err != nil {
-		log.Printf("[ERROR] Could not load environment variables into bot configuration: %s\n", err)
-		os.Exit(-1)
-	}
-
+	*bc = loaded
 	return nil
 }
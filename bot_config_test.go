@@ -2,27 +2,30 @@ package main
 
 import (
 	"errors"
+	"path/filepath"
 	"testing"
 )
 
-func TestLoadEnvVars(t *testing.T) {
-	botCon := BotConfig{
-		Token: "",
-		Name:  "bot_name",
-		ChatAdminConfig: &ChatAdminConfig{
-			ChatId: "",
-			Name:   "admin_name",
-		},
-		ChatConfigs: []ChatConfig{
-			ChatConfig{
+func TestLoadSecrets(t *testing.T) {
+	newBotCon := func() BotConfig {
+		return BotConfig{
+			Token: "",
+			Name:  "bot_name",
+			ChatAdminConfig: &ChatAdminConfig{
 				ChatId: "",
-				Name:   "chat_1_name",
+				Name:   "admin_name",
 			},
-			ChatConfig{
-				ChatId: "",
-				Name:   "chat_2_name",
+			ChatConfigs: []ChatConfig{
+				ChatConfig{
+					ChatId: "",
+					Name:   "chat_1_name",
+				},
+				ChatConfig{
+					ChatId: "",
+					Name:   "chat_2_name",
+				},
 			},
-		},
+		}
 	}
 
 	t.Run("AllEnvVarsExist", func(t *testing.T) {
@@ -32,7 +35,8 @@ func TestLoadEnvVars(t *testing.T) {
 		t.Setenv("bot_name_CHAT_ID_chat_2_name", "78")
 
 		var want error
-		err := loadEnvVars(&botCon)
+		botCon := newBotCon()
+		err := loadSecrets(&botCon, &secretResolver{})
 		if err != want {
 			t.Errorf(errFmtString, want, err)
 		}
@@ -44,7 +48,8 @@ func TestLoadEnvVars(t *testing.T) {
 		t.Setenv("bot_name_CHAT_ID_chat_2_name", "78")
 
 		want := errors.New("some err")
-		err := loadEnvVars(&botCon)
+		botCon := newBotCon()
+		err := loadSecrets(&botCon, &secretResolver{})
 		if err == nil {
 			t.Errorf(errFmtString, want, err)
 		}
@@ -56,7 +61,8 @@ func TestLoadEnvVars(t *testing.T) {
 		t.Setenv("bot_name_CHAT_ID_chat_2_name", "78")
 
 		want := errors.New("some err")
-		err := loadEnvVars(&botCon)
+		botCon := newBotCon()
+		err := loadSecrets(&botCon, &secretResolver{})
 		if err == nil {
 			t.Errorf(errFmtString, want, err)
 		}
@@ -68,7 +74,8 @@ func TestLoadEnvVars(t *testing.T) {
 		t.Setenv("bot_name_CHAT_ID_chat_2_name", "78")
 
 		want := errors.New("some err")
-		err := loadEnvVars(&botCon)
+		botCon := newBotCon()
+		err := loadSecrets(&botCon, &secretResolver{})
 		if err == nil {
 			t.Errorf(errFmtString, want, err)
 		}
@@ -112,3 +119,82 @@ func TestObfuscate(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteFileKeepsSecrets(t *testing.T) {
+	botCon := BotConfig{
+		Token:           "bot_token",
+		Name:            "bot_name",
+		ChatAdminConfig: &ChatAdminConfig{ChatId: "admin_id", Name: "admin_name"},
+		ChatConfigs:     []ChatConfig{{ChatId: "chat_1_id", Name: "chat_1_name"}},
+	}
+
+	path := filepath.Join(t.TempDir(), "botConfig.json")
+	if err := botCon.WriteFile(path); err != nil {
+		t.Fatalf("could not write config: %s\n", err)
+	}
+
+	if botCon.ChatAdminConfig.ChatId != "admin_id" {
+		t.Errorf(errFmtString, "admin_id", botCon.ChatAdminConfig.ChatId)
+	}
+	if botCon.ChatConfigs[0].ChatId != "chat_1_id" {
+		t.Errorf(errFmtString, "chat_1_id", botCon.ChatConfigs[0].ChatId)
+	}
+
+	var written BotConfig
+	if err := written.ReadFile(path); err != nil {
+		t.Fatalf("could not read config: %s\n", err)
+	}
+	if written.Token != "" || written.ChatAdminConfig.ChatId != "" || written.ChatConfigs[0].ChatId != "" {
+		t.Errorf("want: obfuscated config; got: %+v\n", written)
+	}
+}
+
+func TestWriteFileKeepsLiteralSecrets(t *testing.T) {
+	t.Setenv("bot_name_CHAT_ID_chat_2", "chat_2_id")
+	botCon := BotConfig{
+		Token:       "bot_token",
+		Name:        "bot_name",
+		ChatConfigs: []ChatConfig{{ChatId: "chat_1_id", Name: "chat_1"}, {Name: "chat_2"}},
+	}
+	if err := loadSecrets(&botCon, &secretResolver{}); err != nil {
+		t.Fatalf("could not load secrets: %s\n", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "botConfig.json")
+	if err := botCon.WriteFile(path); err != nil {
+		t.Fatalf("could not write config: %s\n", err)
+	}
+
+	var written BotConfig
+	if err := written.ReadFile(path); err != nil {
+		t.Fatalf("could not read config: %s\n", err)
+	}
+	if written.Token != "bot_token" || written.ChatConfigs[0].ChatId != "chat_1_id" {
+		t.Errorf("want: token and chat id given in the config kept; got: %+v\n", written)
+	}
+	if written.ChatConfigs[1].ChatId != "" {
+		t.Errorf("want: chat id read from the environment blanked; got: '%s'\n", written.ChatConfigs[1].ChatId)
+	}
+	if err := loadSecrets(&written, &secretResolver{}); err != nil {
+		t.Errorf("want: written config loads again; got: %s\n", err)
+	}
+}
+
+func TestOptionalAdminChat(t *testing.T) {
+	t.Setenv("BOT_TOKEN_bot_name", "12")
+	t.Setenv("bot_name_CHAT_ID_chat_1_name", "56")
+
+	botCon := BotConfig{
+		Name:        "bot_name",
+		ChatConfigs: []ChatConfig{{Name: "chat_1_name"}},
+	}
+
+	if err := loadSecrets(&botCon, &secretResolver{}); err != nil {
+		t.Errorf("want: no error; got: '%s'\n", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "botConfig.json")
+	if err := botCon.WriteFile(path); err != nil {
+		t.Errorf("want: no error; got: '%s'\n", err)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	tele "gopkg.in/telebot.v3"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatPDFMessage(t *testing.T) {
+	template := "<b>%s</b> <a href=\"%s%s\">%s</a>"
+	sp := SelectiveProc{Name: "A1 Libre"}
+
+	t.Run("RelativeUrl", func(t *testing.T) {
+		want := "<b>A1 Libre</b> <a href=\"https://www.aemet.es/doc.pdf\">Bases &amp; anexos</a>"
+		got := formatPDFMessage(template, &sp, PDF{Url: "/doc.pdf", Name: "Bases & anexos"})
+		if got != want {
+			t.Errorf(errFmtString, want, got)
+		}
+	})
+
+	t.Run("AbsoluteUrl", func(t *testing.T) {
+		want := "<b>A1 Libre</b> <a href=\"https://www.aemet.es/doc.pdf\">Bases</a>"
+		got := formatPDFMessage(template, &sp, PDF{Url: "https://www.aemet.es/doc.pdf", Name: "Bases"})
+		if got != want {
+			t.Errorf(errFmtString, want, got)
+		}
+	})
+}
+
+func TestFilterChats(t *testing.T) {
+	chats := []ChatConfig{
+		{Name: "CHAT_1", SelectiveProcs: []SelectiveProc{{Name: "Test1"}, {Name: "Test2"}}},
+		{Name: "CHAT_2", SelectiveProcs: []SelectiveProc{{Name: "Test1"}}},
+	}
+
+	t.Run("ByChat", func(t *testing.T) {
+		filtered := filterChats(chats, "chat_1")
+		if len(filtered) != 1 || len(filtered[0].SelectiveProcs) != 2 {
+			t.Errorf("want: chat 'CHAT_1' with 2 procs; got: %+v\n", filtered)
+		}
+	})
+
+	t.Run("ByProc", func(t *testing.T) {
+		filtered := filterChats(chats, "Test1")
+		if len(filtered) != 2 {
+			t.Fatalf("want: 2 chats; got: %d\n", len(filtered))
+		}
+		for _, c := range filtered {
+			if len(c.SelectiveProcs) != 1 || c.SelectiveProcs[0].Name != "Test1" {
+				t.Errorf("want: only proc 'Test1'; got: %+v\n", c.SelectiveProcs)
+			}
+		}
+		if len(chats[0].SelectiveProcs) != 2 {
+			t.Errorf("want: original chats untouched; got: %+v\n", chats[0].SelectiveProcs)
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		if filtered := filterChats(chats, "Test3"); len(filtered) != 0 {
+			t.Errorf("want: no chats; got: %+v\n", filtered)
+		}
+	})
+}
+
+// withoutPageCache makes every page be fetched again during the test.
+func withoutPageCache(t *testing.T) {
+	oldPages := pages
+	pages = newPageCache(0)
+	t.Cleanup(func() { pages = oldPages })
+}
+
+func TestProcessSelectiveProcSharedRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div>" +
+			"<span><a href=\"/a.pdf\">Bases (1 KB)</a></span>" +
+			"<span><a href=\"/b.pdf\">Cronograma (2 KB)</a></span>" +
+			"</div>"))
+	}))
+	defer server.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+
+	// chat_1 has been using the registry for a while
+	joined := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	registry := newRegistry("Test1", server.URL)
+	registry.Chats = map[string]time.Time{"chat_1": joined}
+	registry.PDFs["Bases"] = &PDFRecord{Url: "/a.pdf", FirstSeen: joined, Deliveries: map[string]*Delivery{"chat_1": {Status: DELIVERY_SENT}}}
+	path := filepath.Join(dir, "registry.json")
+	if err := writeRegistry(path, registry); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+
+	errCh := make(chan *ProcessingError, 10)
+	sp := &SelectiveProc{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: server.URL}
+	stats := processSelectiveProc(slog.Default(), nil, &ChatConfig{Name: "chat_2"}, sp, errCh, roundOptions{})
+	if stats.PDFsFound != 2 || stats.NewPDFs != 1 || stats.Errors != 0 {
+		t.Errorf("want: 2 pdfs found, 1 new; got: %+v\n", stats)
+	}
+
+	registry, err := readRegistry(path)
+	if err != nil {
+		t.Fatalf("could not read registry: %s\n", err)
+	}
+	if !registry.Chats["chat_1"].Equal(joined) || registry.Chats["chat_2"].IsZero() {
+		t.Errorf("want: chat_2 joined, chat_1 kept; got: %v\n", registry.Chats)
+	}
+	if d := registry.PDFs["Bases"].Deliveries; d["chat_1"].Status != DELIVERY_SENT || d["chat_2"].Status != DELIVERY_SKIPPED {
+		t.Errorf("want: old pdf skipped for chat_2 only; got: %+v\n", d)
+	}
+	if rec := registry.PDFs["Cronograma"]; rec == nil || rec.Size != 2<<10 || rec.Deliveries["chat_2"].Status != DELIVERY_SKIPPED {
+		t.Errorf("want: new pdf registered for chat_2; got: %+v\n", rec)
+	}
+	if _, ok := registry.PDFs["Cronograma"].Deliveries["chat_1"]; ok {
+		t.Errorf("want: new pdf still pending for chat_1\n")
+	}
+}
+
+func TestProcessSelectiveProcRegisteredByOtherChat(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div><span><a href=\"/a.pdf\">Bases (1 KB)</a></span></div>"))
+	}))
+	defer server.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+
+	joined := time.Now().UTC().Add(-time.Hour)
+	tests := []struct {
+		name     string
+		joined   time.Time // by chat_2, zero if new to the registry
+		seen     time.Time // by chat_1
+		backfill bool
+		status   string
+	}{
+		{"SameRound", joined, time.Now().UTC(), false, DELIVERY_SENT},
+		{"BeforeJoining", time.Time{}, joined, false, DELIVERY_SKIPPED},
+		{"Backfill", time.Time{}, joined, true, DELIVERY_SENT},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := newRegistry("Test1", server.URL)
+			registry.Chats = map[string]time.Time{"chat_1": joined}
+			if !test.joined.IsZero() {
+				registry.Chats["chat_2"] = test.joined
+			}
+			registry.PDFs["Bases"] = &PDFRecord{Url: "/a.pdf", FirstSeen: test.seen, LastSeen: test.seen, Deliveries: map[string]*Delivery{"chat_1": {Status: DELIVERY_SENT}}}
+			path := filepath.Join(t.TempDir(), "registry.json")
+			if err := writeRegistry(path, registry); err != nil {
+				t.Fatalf("could not write registry: %s\n", err)
+			}
+
+			bot, tt := newTestBot(t)
+			sp := &SelectiveProc{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: server.URL, Backfill: test.backfill}
+			stats := processSelectiveProc(slog.Default(), bot, &ChatConfig{Name: "chat_2", ChatId: "-300"}, sp, make(chan *ProcessingError, 10), roundOptions{send: true})
+			if stats.Errors != 0 {
+				t.Errorf("want: no errors; got: %+v\n", stats)
+			}
+
+			sent := 0
+			for _, call := range tt.Calls() {
+				if call.Method == "sendMessage" {
+					sent++
+				}
+			}
+			want := 0
+			if test.status == DELIVERY_SENT {
+				want = 1
+			}
+			if sent != want || stats.NewPDFs != want {
+				t.Errorf("want: %d messages sent; got: %d (%+v)\n", want, sent, stats)
+			}
+
+			registry, err := readRegistry(path)
+			if err != nil {
+				t.Fatalf("could not read registry: %s\n", err)
+			}
+			if d := registry.PDFs["Bases"].Deliveries["chat_2"]; d == nil || d.Status != test.status {
+				t.Errorf("want: delivery %s; got: %+v\n", test.status, d)
+			}
+		})
+	}
+}
+
+func TestProcessSelectiveProcDryRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div><span><a href=\"/a.pdf\">Bases (1 KB)</a></span></div>"))
+	}))
+	defer server.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("<b>%s</b> <a href=\"%s%s\">%s</a>"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+	path := filepath.Join(dir, "registry.json")
+	if err := writeRegistry(path, newRegistry("Test1", server.URL)); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+
+	var out strings.Builder
+	sp := &SelectiveProc{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: server.URL}
+	stats := processSelectiveProc(slog.Default(), nil, &ChatConfig{Name: "chat_1"}, sp, make(chan *ProcessingError, 10), roundOptions{send: true, dryRun: &out})
+
+	want := "=== chat_1/Test1: Bases\n<b>Test1</b> <a href=\"https://www.aemet.es/a.pdf\">Bases</a>\n\n"
+	if stats.NewPDFs != 1 || out.String() != want {
+		t.Errorf(errFmtString, want, out.String())
+	}
+	if registry, err := readRegistry(path); err != nil || len(registry.PDFs) != 0 || len(registry.Chats) != 0 {
+		t.Errorf("want: registry untouched; got: %+v (%v)\n", registry, err)
+	}
+}
+
+func TestProcessSelectiveProcUnchanged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div><span><a href=\"/a.pdf\">Bases (1 KB)</a></span></div>"))
+	}))
+	defer server.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+	path := filepath.Join(dir, "registry.json")
+	sp := &SelectiveProc{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: server.URL}
+	round := func() time.Time {
+		t.Helper()
+		processSelectiveProc(slog.Default(), nil, &ChatConfig{Name: "chat_1"}, sp, make(chan *ProcessingError, 10), roundOptions{})
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("could not stat registry: %s\n", err)
+		}
+		return info.ModTime()
+	}
+
+	round()
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatalf("could not set registry times: %s\n", err)
+	}
+	if modTime := round(); !modTime.Equal(past) {
+		t.Errorf("want: registry not written when only LastSeen changed; got: modified at %s\n", modTime)
+	}
+
+	registry, err := readRegistry(path)
+	if err != nil {
+		t.Fatalf("could not read registry: %s\n", err)
+	}
+	registry.PDFs["Bases"].LastSeen = registry.PDFs["Bases"].LastSeen.Add(-REGISTRY_LAST_SEEN_PRECISION)
+	if err := writeRegistry(path, registry); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatalf("could not set registry times: %s\n", err)
+	}
+	if modTime := round(); modTime.Equal(past) {
+		t.Errorf("want: registry written once LastSeen is a day old\n")
+	}
+}
+
+func TestSelectChats(t *testing.T) {
+	chats := []ChatConfig{
+		{Name: "CHAT_1", SelectiveProcs: []SelectiveProc{{Name: "Test1"}, {Name: "Test2"}}},
+		{Name: "CHAT_2", SelectiveProcs: []SelectiveProc{{Name: "Test1"}}},
+	}
+
+	tests := []struct {
+		name     string
+		chat     string
+		proc     string
+		selected []string
+	}{
+		{"All", "", "", []string{"CHAT_1/Test1", "CHAT_1/Test2", "CHAT_2/Test1"}},
+		{"Chat", "chat_1", "", []string{"CHAT_1/Test1", "CHAT_1/Test2"}},
+		{"Proc", "", "test1", []string{"CHAT_1/Test1", "CHAT_2/Test1"}},
+		{"Both", "CHAT_2", "Test1", []string{"CHAT_2/Test1"}},
+		{"None", "CHAT_2", "Test2", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var selected []string
+			for _, c := range selectChats(chats, test.chat, test.proc) {
+				for _, sp := range c.SelectiveProcs {
+					selected = append(selected, c.Name+"/"+sp.Name)
+				}
+			}
+			if strings.Join(selected, ",") != strings.Join(test.selected, ",") {
+				t.Errorf("want: %q; got: %q\n", test.selected, selected)
+			}
+		})
+	}
+}
+
+func TestTick(t *testing.T) {
+	newInstance := func() *botInstance {
+		b := &botInstance{
+			lc:     newLiveConfig("", BotConfig{Name: "bot_name", TimeInterval: Duration(time.Minute)}),
+			errCh:  make(chan *ProcessingError, 50),
+			errors: newErrorAggregator(),
+		}
+		b.bot, _ = newTestBot(t)
+		return b
+	}
+
+	t.Run("PausedDrainsErrors", func(t *testing.T) {
+		b := newInstance()
+		b.paused.Store(true)
+		c, sp := &ChatConfig{Name: "chat_1"}, &SelectiveProc{Name: "Test1"}
+		for range cap(b.errCh) {
+			b.errCh <- newProcessingError(GetUrlContentError, c, sp, nil)
+		}
+
+		now := time.Now()
+		b.tick(now)
+		if n := len(b.errCh); n != 0 {
+			t.Errorf("want: errors drained while paused; got: %d pending\n", n)
+		}
+		if !b.nextRound.IsZero() || b.running.Load() {
+			t.Errorf("want: no round started while paused\n")
+		}
+	})
+
+	t.Run("SkipsRunningRound", func(t *testing.T) {
+		b := newInstance()
+		b.running.Store(true)
+		roundId := lastRoundId.Load()
+
+		now := time.Now()
+		b.tick(now)
+		if !b.nextRound.Equal(now.Add(time.Minute)) {
+			t.Errorf("want: next round at %s; got: %s\n", now.Add(time.Minute), b.nextRound)
+		}
+		if lastRoundId.Load() != roundId {
+			t.Errorf("want: no round started while one is running\n")
+		}
+	})
+}
+
+func TestProcessChatsIndependentRegistries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div><span><a href=\"/a.pdf\">Bases (1 KB)</a></span></div>"))
+	}))
+	defer server.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+	newChat := func(name string) ChatConfig {
+		path := filepath.Join(dir, name+".json")
+		if err := writeRegistry(path, newRegistry("Test1", server.URL+"/"+name)); err != nil {
+			t.Fatalf("could not write registry: %s\n", err)
+		}
+		return ChatConfig{Name: name, SelectiveProcs: []SelectiveProc{{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: server.URL + "/" + name}}}
+	}
+	busy, free := newChat("busy"), newChat("free")
+
+	// a slow round of another bot holds its registry
+	unlock := lockRegistry(busy.SelectiveProcs[0].RegistryPath)
+	roundId := lastRoundId.Load()
+	busyDone := make(chan struct{})
+	go func() {
+		defer close(busyDone)
+		processChats(nil, []ChatConfig{busy}, make(chan *ProcessingError, 10), roundOptions{})
+	}()
+	for lastRoundId.Load() == roundId {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan roundSummary)
+	go func() { done <- processChats(nil, []ChatConfig{free}, make(chan *ProcessingError, 10), roundOptions{}) }()
+	select {
+	case summary := <-done:
+		if summary.Procs != 1 || summary.FailedProcs != 0 {
+			t.Errorf("want: 1 proc processed; got: %+v\n", summary)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("want: round not blocked by another registry\n")
+	}
+
+	unlock()
+	<-busyDone
+}
+
+func TestProcessChatsFreshSharedRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div><span><a href=\"/a.pdf\">Bases (1 KB)</a></span></div>"))
+	}))
+	defer server.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+	path := filepath.Join(dir, "registry.json") // created by the first chat
+	sp := SelectiveProc{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: server.URL}
+	chats := []ChatConfig{
+		{Name: "chat_1", ChatId: "-300", SelectiveProcs: []SelectiveProc{sp}},
+		{Name: "chat_2", ChatId: "-301", SelectiveProcs: []SelectiveProc{sp}},
+	}
+
+	bot, tt := newTestBot(t)
+	summary := processChats(bot, chats, make(chan *ProcessingError, 10), roundOptions{send: true})
+	if summary.FailedProcs != 0 || summary.NewPDFs != 2 {
+		t.Errorf("want: the pdf new to both chats; got: %+v\n", summary)
+	}
+
+	sent := 0
+	for _, call := range tt.Calls() {
+		if call.Method == "sendMessage" {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Errorf("want: 2 messages sent; got: %d\n", sent)
+	}
+
+	registry, err := readRegistry(path)
+	if err != nil {
+		t.Fatalf("could not read registry: %s\n", err)
+	}
+	for _, chat := range []string{"chat_1", "chat_2"} {
+		if d := registry.PDFs["Bases"].Deliveries[chat]; d == nil || d.Status != DELIVERY_SENT {
+			t.Errorf("want: delivery to %s sent; got: %+v\n", chat, d)
+		}
+	}
+}
+
+func TestProcessSelectiveProcSendsUnlocked(t *testing.T) {
+	page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div><span><a href=\"/a.pdf\">Bases (1 KB)</a></span></div>"))
+	}))
+	defer page.Close()
+	withoutPageCache(t)
+
+	sending, release := make(chan struct{}), make(chan struct{})
+	telegram := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(sending)
+		<-release
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1, "chat": {"id": -300}}}`))
+	}))
+	defer telegram.Close()
+	bot, err := tele.NewBot(tele.Settings{URL: telegram.URL, Token: "token", Offline: true})
+	if err != nil {
+		t.Fatalf("could not create bot: %s\n", err)
+	}
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+	path := filepath.Join(dir, "registry.json")
+	sp := &SelectiveProc{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: page.URL}
+
+	done := make(chan procStats)
+	go func() {
+		done <- processSelectiveProc(slog.Default(), bot, &ChatConfig{Name: "chat_1", ChatId: "-300"}, sp, make(chan *ProcessingError, 10), roundOptions{send: true})
+	}()
+	<-sending
+
+	locked := make(chan struct{})
+	go func() {
+		lockRegistry(path)()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Errorf("want: registry not locked while sending\n")
+	}
+	close(release)
+
+	if stats := <-done; stats.Errors != 0 {
+		t.Errorf("want: no errors; got: %+v\n", stats)
+	}
+	registry, err := readRegistry(path)
+	if err != nil {
+		t.Fatalf("could not read registry: %s\n", err)
+	}
+	if d := registry.PDFs["Bases"].Deliveries["chat_1"]; d == nil || d.Status != DELIVERY_SENT || d.MessageId != 1 {
+		t.Errorf("want: delivery sent; got: %+v\n", d)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Exit codes of the check command.
+const (
+	CHECK_OK              = 0
+	CHECK_PARTIAL_FAILURE = 1 // some selective processes had errors
+	CHECK_FAILURE         = 2 // every selective process had errors, or the bot could not run
+)
+
+// runOnce runs a round over chats and waits for it to finish. Errors are
+// delivered to the admin chats and error sinks as they happen, the first of
+// every kind right away and its repeats rolled up at the end, and runOnce
+// waits for the error sinks to send them.
+func runOnce(bot *tele.Bot, bc *BotConfig, chats []ChatConfig, opts roundOptions) roundSummary {
+	errCh := make(chan *ProcessingError)
+	aggregator := newErrorAggregator()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for pe := range errCh {
+			now := time.Now()
+			if alert, ok := aggregator.Add(pe, now); ok {
+				deliverAlert(bot, bc, alert, now)
+			}
+		}
+	}()
+
+	opts.bot = bc.Name
+	summary := processChats(bot, chats, errCh, opts)
+	close(errCh)
+	<-done
+
+	now := time.Now()
+	for _, alert := range aggregator.Flush(now, 0, bc.errorResolveAfter()) {
+		deliverAlert(bot, bc, alert, now)
+	}
+	flushSinks()
+	return summary
+}
+
+// checkExitCode tells how the round went: ok, partial or total failure.
+func checkExitCode(summary roundSummary) int {
+	switch {
+	case summary.FailedProcs == 0:
+		return CHECK_OK
+	case summary.FailedProcs < summary.Procs:
+		return CHECK_PARTIAL_FAILURE
+	}
+	return CHECK_FAILURE
+}
+
+// handle_check_command runs a single round, sending the new pdfs, for
+// deployments running the bot from a timer instead of as a service.
+func handle_check_command(configPath string) {
+	var botConfig BotConfig
+	if err := botConfig.SetUp(configPath); err != nil {
+		os.Exit(CHECK_FAILURE)
+	}
+
+	logFile, err := setupLogging(botConfig.Log)
+	if err != nil {
+		slog.Error("Could not set up logging", "error", err)
+		os.Exit(CHECK_FAILURE)
+	}
+
+	bot, err := newTeleBot(&botConfig)
+	if err != nil {
+		os.Exit(CHECK_FAILURE)
+	}
+
+	slog.Info("Starting check", "bot", botConfig.Name)
+	summary := runOnce(bot, &botConfig, botConfig.ChatConfigs, roundOptions{send: true})
+	fmt.Printf("[INFO] Check finished in %s: %d pages fetched, %d pdfs found, %d new pdfs, %d errors in %d of %d selective processes\n",
+		summary.Duration.Round(time.Millisecond), summary.PagesFetched, summary.PDFsFound, summary.NewPDFs, summary.Errors, summary.FailedProcs, summary.Procs)
+
+	logFile.Close()
+	os.Exit(checkExitCode(summary))
+}
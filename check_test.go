@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckExitCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		summary roundSummary
+		want    int
+	}{
+		{"Ok", roundSummary{Procs: 2}, CHECK_OK},
+		{"Partial", roundSummary{Procs: 2, FailedProcs: 1}, CHECK_PARTIAL_FAILURE},
+		{"Failure", roundSummary{Procs: 2, FailedProcs: 2}, CHECK_FAILURE},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := checkExitCode(test.summary); got != test.want {
+				t.Errorf("want: %d; got: %d\n", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div>no documents yet</div>"))
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+	for _, name := range []string{"ok.json", "fail.json"} {
+		if err := writeRegistry(filepath.Join(dir, name), newRegistry("", "")); err != nil {
+			t.Fatalf("could not write registry: %s\n", err)
+		}
+	}
+
+	alerts := filepath.Join(dir, "alerts.txt")
+	bc := BotConfig{
+		Name:   "bot_1",
+		Errors: &ErrorsConfig{Sinks: []ErrorSinkConfig{{Type: FILE_SINK, Path: alerts}}},
+		ChatConfigs: []ChatConfig{{Name: "chat_1", SelectiveProcs: []SelectiveProc{
+			{Name: "Ok", TemplatePath: template, RegistryPath: filepath.Join(dir, "ok.json"), Url: server.URL + "/ok"},
+			{Name: "Fail", TemplatePath: template, RegistryPath: filepath.Join(dir, "fail.json"), Url: closed.URL},
+		}}},
+	}
+
+	summary := runOnce(nil, &bc, bc.ChatConfigs, roundOptions{send: true})
+	if summary.Procs != 2 || summary.FailedProcs != 1 || checkExitCode(summary) != CHECK_PARTIAL_FAILURE {
+		t.Errorf("want: 1 of 2 procs failed; got: %+v\n", summary)
+	}
+
+	data, err := os.ReadFile(alerts)
+	if err != nil {
+		t.Fatalf("could not read alerts: %s\n", err)
+	}
+	if !strings.Contains(string(data), "GetUrlContentError in chat_1/Fail") {
+		t.Errorf("want: fetch error delivered before returning; got: '%s'\n", data)
+	}
+}
+
+func TestRunOnceFreshRegistry(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<div><span><a href=\"/a.pdf\">Bases (1 KB)</a></span></div>"))
+	}))
+	defer server.Close()
+	withoutPageCache(t)
+
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+	path := filepath.Join(dir, "pdfs-test1.json")
+	bc := BotConfig{Name: "bot_1", ChatConfigs: []ChatConfig{{Name: "chat_1", SelectiveProcs: []SelectiveProc{
+		{Name: "Test1", TemplatePath: template, RegistryPath: path, Url: server.URL},
+	}}}}
+
+	// as init does
+	summary := runOnce(nil, &bc, bc.ChatConfigs, roundOptions{})
+	if summary.Procs != 1 || summary.FailedProcs != 0 || summary.Errors != 0 {
+		t.Errorf("want: missing registry not an error; got: %+v\n", summary)
+	}
+
+	registry, err := readRegistry(path)
+	if err != nil {
+		t.Fatalf("could not read registry: %s\n", err)
+	}
+	if d := registry.PDFs["Bases"].Deliveries["chat_1"]; registry.Proc != "Test1" || d == nil || d.Status != DELIVERY_SKIPPED {
+		t.Errorf("want: registry created with the pdf skipped; got: %+v\n", registry)
+	}
+}
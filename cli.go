@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+const PROGRAM_NAME = "aemet_tg_bot"
+
+// Config used when no --bot-config is given, unless CONFIG_PATH_ENV is set.
+const (
+	DEFAULT_CONFIG_PATH = "./botConfig.json"
+	CONFIG_PATH_ENV     = "AEMET_TG_BOT_CONFIG"
+)
+
+// Set at build time with -ldflags "-X main.version=v1.2.3". If empty, the
+// version is taken from the build info.
+var version string
+
+func versionString() string {
+	if version != "" {
+		return version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && len(setting.Value) >= 12 {
+			return "devel-" + setting.Value[:12]
+		}
+	}
+	return "devel"
+}
+
+// defaultConfigPath returns the config used when none is given.
+func defaultConfigPath() string {
+	if path := os.Getenv(CONFIG_PATH_ENV); path != "" {
+		return path
+	}
+	return DEFAULT_CONFIG_PATH
+}
+
+// stringList is a flag that can be repeated, e.g. --bot-config of run.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// cliCommand is a command of the program, with its own flags.
+type cliCommand struct {
+	name        string
+	args        string // after the flags, in the usage line
+	summary     string // in the list of commands
+	help        string // in the help of the command, after the summary
+	subcommands []string
+	failCode    int  // exit code on invalid arguments, -1 if zero
+	logLevel    bool // takes --log-level
+	// setup defines the flags of the command and returns what runs it with
+	// the arguments left after them
+	setup func(cmd *cliCommand, fs *flag.FlagSet) func(args []string)
+}
+
+func (cmd *cliCommand) exitCode() int {
+	if cmd.failCode != 0 {
+		return cmd.failCode
+	}
+	return -1
+}
+
+// configFlag defines --bot-config and -c, defaulting to defaultConfigPath.
+func configFlag(fs *flag.FlagSet) *string {
+	path := new(string)
+	fs.StringVar(path, "bot-config", "", fmt.Sprintf("config file (default $%s or %s)", CONFIG_PATH_ENV, DEFAULT_CONFIG_PATH))
+	fs.StringVar(path, "c", "", "shorthand for --bot-config")
+	return path
+}
+
+func configOrDefault(path string) string {
+	if path == "" {
+		return defaultConfigPath()
+	}
+	return path
+}
+
+// noArgs fails if args, left after the flags, is not empty.
+func noArgs(cmd *cliCommand, args []string) {
+	if len(args) > 0 {
+		cliFail(cmd, "Unexpected argument '%s' for command '%s'", args[0], cmd.name)
+	}
+}
+
+var cliCommands []*cliCommand
+
+func init() {
+	cliCommands = []*cliCommand{
+		{
+			name:     "run",
+			logLevel: true,
+			summary:  "Start running the bot.",
+			help: "Repeat --bot-config to run several bots in the same process.\n" +
+				"With --dry-run, run one round printing the messages of the new pdfs to\n" +
+				"stdout or --output instead: registries are not written and nothing is\n" +
+				"sent to Telegram, so no secrets are needed.",
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				var paths stringList
+				fs.Var(&paths, "bot-config", fmt.Sprintf("config file, repeatable (default $%s or %s)", CONFIG_PATH_ENV, DEFAULT_CONFIG_PATH))
+				fs.Var(&paths, "c", "shorthand for --bot-config")
+				dryRun := fs.Bool("dry-run", false, "print the messages of one round instead of sending them")
+				output := fs.String("output", "", "with --dry-run, file the messages are written to")
+				return func(args []string) {
+					noArgs(cmd, args)
+					if len(paths) == 0 {
+						paths = stringList{defaultConfigPath()}
+					}
+					if *dryRun {
+						handle_dry_run_command(paths, true, *output, "", "")
+						return
+					}
+					if *output != "" {
+						cliFail(cmd, "The flag '--output' needs '--dry-run'")
+					}
+					handle_run_command(paths)
+				}
+			},
+		},
+		{
+			name:     "init",
+			logLevel: true,
+			summary:  "Initialise the registries without sending any pdf.",
+			help: "Only the errors are sent, to the admin chats and error sinks. --chat and\n" +
+				"--proc only initialise the matching selective processes. With --dry-run\n" +
+				"the pdfs that would be registered are printed instead.",
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				path := configFlag(fs)
+				chatName := fs.String("chat", "", "only the selective processes of this chat")
+				procName := fs.String("proc", "", "only the selective processes with this name")
+				dryRun := fs.Bool("dry-run", false, "print the pdfs that would be registered")
+				output := fs.String("output", "", "with --dry-run, file the pdfs are written to")
+				return func(args []string) {
+					noArgs(cmd, args)
+					if *dryRun {
+						handle_dry_run_command([]string{configOrDefault(*path)}, false, *output, *chatName, *procName)
+						return
+					}
+					if *output != "" {
+						cliFail(cmd, "The flag '--output' needs '--dry-run'")
+					}
+					handle_init_command(configOrDefault(*path), *chatName, *procName)
+				}
+			},
+		},
+		{
+			name:     "check",
+			logLevel: true,
+			summary:  "Run one round and exit, for timers and cron.",
+			help:     "Exits with 0 if every selective process succeeded, 1 if some failed and 2\nif all failed or the bot could not start.",
+			failCode: CHECK_FAILURE,
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				path := configFlag(fs)
+				return func(args []string) {
+					noArgs(cmd, args)
+					handle_check_command(configOrDefault(*path))
+				}
+			},
+		},
+		{
+			name:     "validate",
+			logLevel: true,
+			summary:  "Check the configuration and report all the problems found.",
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				path := configFlag(fs)
+				return func(args []string) {
+					noArgs(cmd, args)
+					handle_validate_command(configOrDefault(*path))
+				}
+			},
+		},
+		{
+			name:     "replay",
+			logLevel: true,
+			summary:  "Send a chat the pdfs it missed, or those since a date, again.",
+			help: "By default the pdfs of the selective process whose delivery to the chat\n" +
+				"failed or is missing, oldest first, and with --include-skipped those skipped\n" +
+				"too, e.g. registered by init; with --since, every pdf seen since the date\n" +
+				"(2024-03-01, 01/03/2024 or RFC 3339). Pdfs no longer in the page are left out.",
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				path := configFlag(fs)
+				chatName := fs.String("chat", "", "chat the pdfs are sent to (required)")
+				procName := fs.String("proc", "", "selective process of the chat (required)")
+				since := fs.String("since", "", "replay every pdf seen since this date")
+				includeSkipped := fs.Bool("include-skipped", false, "replay the pdfs skipped for the chat too")
+				dryRun := fs.Bool("dry-run", false, "print the messages without sending them")
+				return func(args []string) {
+					noArgs(cmd, args)
+					handle_replay_command(configOrDefault(*path), *chatName, *procName, *since, *includeSkipped, *dryRun)
+				}
+			},
+		},
+		{
+			name:        "registry",
+			args:        "<subcommand> [flags] [args]",
+			summary:     "Inspect and migrate the registries.",
+			help:        "See '" + PROGRAM_NAME + " registry help' for the subcommands.",
+			subcommands: []string{"list", "show", "diff", "migrate", "normalize", "rm", "import", "export", "help"},
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				// the subcommands parse their own flags
+				return handle_registry_command
+			},
+		},
+		{
+			name:        "completion",
+			args:        "bash|zsh|fish",
+			summary:     "Print the shell completion script.",
+			help:        "e.g. source <(" + PROGRAM_NAME + " completion bash)",
+			subcommands: []string{"bash", "zsh", "fish"},
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				return func(args []string) {
+					if len(args) != 1 {
+						cliFail(cmd, "Missing shell for command 'completion'")
+					}
+					if err := writeCompletion(os.Stdout, args[0]); err != nil {
+						cliFail(cmd, "%s", err)
+					}
+				}
+			},
+		},
+		{
+			name:    "version",
+			summary: "Print the version.",
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				return func(args []string) {
+					fmt.Println(PROGRAM_NAME, versionString())
+				}
+			},
+		},
+		{
+			name:    "help",
+			args:    "[command]",
+			summary: "Print this help, or that of a command.",
+			setup: func(cmd *cliCommand, fs *flag.FlagSet) func([]string) {
+				return func(args []string) {
+					if len(args) == 0 {
+						usage(os.Stdout)
+						return
+					}
+					cmd := findCommand(args[0])
+					if cmd == nil {
+						usage(os.Stdout)
+						cliFail(nil, "Unknown command '%s'", args[0])
+					}
+					fs, _ := newCommandFlagSet(cmd)
+					fs.Usage()
+				}
+			},
+		},
+	}
+}
+
+// findCommand returns the command named name, nil if there is none.
+func findCommand(name string) *cliCommand {
+	for _, cmd := range cliCommands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// newCommandFlagSet returns the flags of the command, --log-level included,
+// and what runs it.
+func newCommandFlagSet(cmd *cliCommand) (*flag.FlagSet, func(args []string)) {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(os.Stdout)
+	run := cmd.setup(cmd, fs)
+	if cmd.logLevel {
+		fs.Func("log-level", "debug, info, warn or error, overriding the config", func(value string) error {
+			var level slog.Level
+			if err := level.UnmarshalText([]byte(value)); err != nil {
+				return fmt.Errorf("unknown level '%s', use debug, info, warn or error", value)
+			}
+			logLevelOverride = value
+			return nil
+		})
+	}
+
+	fs.Usage = func() {
+		out := fs.Output()
+		args := cmd.args
+		if hasFlags(fs) {
+			args = strings.TrimSpace("[flags] " + args)
+		}
+		fmt.Fprintf(out, "usage: %s %s %s\n\n%s\n", PROGRAM_NAME, cmd.name, args, cmd.summary)
+		if cmd.help != "" {
+			fmt.Fprintf(out, "%s\n", cmd.help)
+		}
+		if hasFlags(fs) {
+			fmt.Fprintf(out, "\nflags:\n")
+			fs.PrintDefaults()
+		}
+	}
+	return fs, run
+}
+
+func hasFlags(fs *flag.FlagSet) bool {
+	found := false
+	fs.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+// exitf prints the error and exits with code, -1 for every command but check.
+func exitf(code int, format string, a ...any) {
+	fmt.Printf("[ERROR] "+format+"\n", a...)
+	os.Exit(code)
+}
+
+// cliFail prints the error, with the usage of cmd if any, and exits with its
+// failure code.
+func cliFail(cmd *cliCommand, format string, a ...any) {
+	code := -1
+	if cmd != nil {
+		fs, _ := newCommandFlagSet(cmd)
+		fs.Usage()
+		code = cmd.exitCode()
+	}
+	exitf(code, format, a...)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags] [args]\n\ncommands:\n", PROGRAM_NAME)
+	for _, cmd := range cliCommands {
+		fmt.Fprintf(w, "    %-12s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(w, "\nThe config is $%s, or %s if not set, unless given with\n"+
+		"--bot-config or -c. The commands taking a config also take --log-level.\n"+
+		"Run '%s help <command>' for the flags of a command.\n",
+		CONFIG_PATH_ENV, DEFAULT_CONFIG_PATH, PROGRAM_NAME)
+}
+
+// writeCompletion writes the completion script of shell: the commands, their
+// flags and their subcommands. Flag values complete as files.
+func writeCompletion(w io.Writer, shell string) error {
+	var names []string
+	flagsOf := map[string][]string{}
+	wordsOf := map[string][]string{}
+	for _, cmd := range cliCommands {
+		names = append(names, cmd.name)
+		fs, _ := newCommandFlagSet(cmd)
+		fs.VisitAll(func(f *flag.Flag) {
+			if len(f.Name) > 1 {
+				flagsOf[cmd.name] = append(flagsOf[cmd.name], f.Name)
+			}
+		})
+		sort.Strings(flagsOf[cmd.name])
+		wordsOf[cmd.name] = cmd.subcommands
+	}
+	wordsOf["help"] = names
+	// the registry subcommands parse their own flags
+	wordsOf["registry"] = append(wordsOf["registry"], "--bot-config", "--dry-run", "--format")
+
+	switch shell {
+	case "bash", "zsh":
+		if shell == "zsh" {
+			fmt.Fprintf(w, "autoload -U +X bashcompinit && bashcompinit\n")
+		}
+		fmt.Fprintf(w, "_%s() {\n", PROGRAM_NAME)
+		fmt.Fprintf(w, "    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+		fmt.Fprintf(w, "    if [ \"$COMP_CWORD\" -eq 1 ]; then\n")
+		fmt.Fprintf(w, "        COMPREPLY=($(compgen -W \"%s --version\" -- \"$cur\"))\n", strings.Join(names, " "))
+		fmt.Fprintf(w, "        return\n    fi\n")
+		fmt.Fprintf(w, "    case \"${COMP_WORDS[1]}\" in\n")
+		for _, name := range names {
+			var words []string
+			for _, f := range flagsOf[name] {
+				words = append(words, "--"+f)
+			}
+			words = append(words, wordsOf[name]...)
+			if len(words) > 0 {
+				fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -W \"%s\" -- \"$cur\")) ;;\n", name, strings.Join(words, " "))
+			}
+		}
+		fmt.Fprintf(w, "    esac\n}\n")
+		fmt.Fprintf(w, "complete -o default -F _%s %s\n", PROGRAM_NAME, PROGRAM_NAME)
+	case "fish":
+		fmt.Fprintf(w, "complete -c %s -f\n", PROGRAM_NAME)
+		fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -l version -d 'Print the version'\n", PROGRAM_NAME)
+		for _, cmd := range cliCommands {
+			fmt.Fprintf(w, "complete -c %s -n __fish_use_subcommand -a %s -d %s\n", PROGRAM_NAME, cmd.name, fishQuote(cmd.summary))
+			fs, _ := newCommandFlagSet(cmd)
+			fs.VisitAll(func(f *flag.Flag) {
+				if len(f.Name) == 1 {
+					return
+				}
+				value := " -r -F"
+				if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+					value = ""
+				}
+				fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s' -l %s%s -d %s\n", PROGRAM_NAME, cmd.name, f.Name, value, fishQuote(f.Usage))
+			})
+			if words := wordsOf[cmd.name]; len(words) > 0 {
+				fmt.Fprintf(w, "complete -c %s -n '__fish_seen_subcommand_from %s' -a %s\n", PROGRAM_NAME, cmd.name, fishQuote(strings.Join(words, " ")))
+			}
+		}
+	default:
+		return fmt.Errorf("unknown shell '%s', use bash, zsh or fish", shell)
+	}
+	return nil
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "\\'") + "'"
+}
+
+func main() {
+	if len(os.Args) <= 1 {
+		usage(os.Stdout)
+		cliFail(nil, "No command provided")
+	}
+
+	switch os.Args[1] {
+	case "--version", "-version", "-v":
+		fmt.Println(PROGRAM_NAME, versionString())
+		return
+	case "--help", "-help", "-h":
+		usage(os.Stdout)
+		return
+	}
+
+	cmd := findCommand(os.Args[1])
+	if cmd == nil {
+		usage(os.Stdout)
+		cliFail(nil, "Unknown command '%s'", os.Args[1])
+	}
+
+	fs, run := newCommandFlagSet(cmd)
+	if cmd.name == "registry" {
+		run(os.Args[2:]) // its subcommands parse the flags
+		return
+	}
+	if err := fs.Parse(os.Args[2:]); errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		os.Exit(cmd.exitCode())
+	}
+
+	if logLevelOverride != "" {
+		setupLogging(nil) // commands without logging config log at that level too
+	}
+	run(fs.Args())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDefaultConfigPath(t *testing.T) {
+	t.Setenv(CONFIG_PATH_ENV, "")
+	if got := configOrDefault(""); got != DEFAULT_CONFIG_PATH {
+		t.Errorf("want: %s; got: %s\n", DEFAULT_CONFIG_PATH, got)
+	}
+
+	t.Setenv(CONFIG_PATH_ENV, "/etc/aemet_tg_bot/botConfig.yaml")
+	if got := configOrDefault(""); got != "/etc/aemet_tg_bot/botConfig.yaml" {
+		t.Errorf("want: %s; got: %s\n", "/etc/aemet_tg_bot/botConfig.yaml", got)
+	}
+	if got := configOrDefault("other.json"); got != "other.json" {
+		t.Errorf("want: %s; got: %s\n", "other.json", got)
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		args    []string
+		want    string
+	}{
+		{"Equals", "check", []string{"--bot-config=a.json"}, "a.json"},
+		{"Separate", "check", []string{"--bot-config", "a.json"}, "a.json"},
+		{"Short", "check", []string{"-c", "a.json"}, "a.json"},
+		{"Repeated", "run", []string{"-c", "a.json", "--bot-config", "b.json"}, "a.json,b.json"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fs, _ := newCommandFlagSet(findCommand(test.command))
+			if err := fs.Parse(test.args); err != nil {
+				t.Fatal(err)
+			}
+			if got := fs.Lookup("bot-config").Value.String(); got != test.want {
+				t.Errorf("want: %s; got: %s\n", test.want, got)
+			}
+		})
+	}
+}
+
+func TestLogLevelFlag(t *testing.T) {
+	defer func() { logLevelOverride = "" }()
+
+	fs, _ := newCommandFlagSet(findCommand("validate"))
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse([]string{"--log-level", "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	if logLevelOverride != "debug" {
+		t.Errorf("want: debug; got: %s\n", logLevelOverride)
+	}
+	if err := fs.Parse([]string{"--log-level=loud"}); err == nil {
+		t.Errorf("want an error for an unknown level\n")
+	}
+
+	fs, _ = newCommandFlagSet(findCommand("registry"))
+	if fs.Lookup("log-level") != nil {
+		t.Errorf("registry parses its own flags, it must not take --log-level\n")
+	}
+}
+
+func TestWriteCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		t.Run(shell, func(t *testing.T) {
+			var b strings.Builder
+			if err := writeCompletion(&b, shell); err != nil {
+				t.Fatal(err)
+			}
+			for _, cmd := range cliCommands {
+				if !strings.Contains(b.String(), cmd.name) {
+					t.Errorf("command '%s' missing\n", cmd.name)
+				}
+			}
+			for _, f := range []string{"bot-config", "log-level", "dry-run", "since"} {
+				if !strings.Contains(b.String(), f) {
+					t.Errorf("flag '%s' missing\n", f)
+				}
+			}
+		})
+	}
+
+	if err := writeCompletion(io.Discard, "powershell"); err == nil {
+		t.Errorf("want an error for an unknown shell\n")
+	}
+}
+
+// Every command must define its flags without panicking, e.g. on a flag
+// defined twice.
+func TestCommandFlagSets(t *testing.T) {
+	for _, cmd := range cliCommands {
+		fs, run := newCommandFlagSet(cmd)
+		if run == nil {
+			t.Errorf("command '%s' has nothing to run\n", cmd.name)
+		}
+		if cmd.logLevel && fs.Lookup("log-level") == nil {
+			t.Errorf("command '%s' misses --log-level\n", cmd.name)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that config files can write either as a number
+// of nanoseconds (5000000000) or as a string ("5s", "1m30s").
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(strings.TrimSpace(string(text)))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		*d = Duration(v)
+		return nil
+	case string:
+		if err := d.UnmarshalText([]byte(v)); err != nil {
+			return &json.UnmarshalTypeError{Value: fmt.Sprintf("string %q", v), Type: reflect.TypeOf(d).Elem()}
+		}
+		return nil
+	}
+	return &json.UnmarshalTypeError{Value: string(data), Type: reflect.TypeOf(d).Elem()}
+}
+
+type configFormat int
+
+const (
+	JSON_FORMAT configFormat = iota
+	YAML_FORMAT
+	TOML_FORMAT
+)
+
+// configFormatOf picks the format of a config file from its extension. Files
+// with any other extension, or none, are JSON like before other formats were
+// supported.
+func configFormatOf(path string) configFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAML_FORMAT
+	case ".toml":
+		return TOML_FORMAT
+	default:
+		return JSON_FORMAT
+	}
+}
+
+// configToJSON converts a config file in the given format to JSON, so every
+// format goes through the same decoding and checks.
+func configToJSON(data []byte, format configFormat) ([]byte, error) {
+	var raw any
+	switch format {
+	case JSON_FORMAT:
+		return data, nil
+	case YAML_FORMAT:
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+	case TOML_FORMAT:
+		var table map[string]any
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return nil, fmt.Errorf("invalid TOML: %w", err)
+		}
+		raw = table
+	}
+
+	if raw == nil {
+		raw = map[string]any{}
+	}
+	return json.Marshal(raw)
+}
+
+// plainYAMLStyle removes the JSON styles (quotes, flow mappings) from the
+// nodes, so they are written as regular block YAML.
+func plainYAMLStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		plainYAMLStyle(child)
+	}
+}
+
+// marshalConfig encodes the configuration in the given format.
+func marshalConfig(bc *BotConfig, format configFormat) ([]byte, error) {
+	bc_data, err := json.MarshalIndent(bc, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case YAML_FORMAT:
+		// going through JSON keeps the field names and order of the JSON files
+		var node yaml.Node
+		if err = yaml.Unmarshal(bc_data, &node); err != nil {
+			return nil, err
+		}
+		plainYAMLStyle(&node)
+
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(4)
+		if err = enc.Encode(&node); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), enc.Close()
+	case TOML_FORMAT:
+		var buf bytes.Buffer
+		if err = toml.NewEncoder(&buf).Encode(bc); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	return bc_data, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	var tests = []struct {
+		data string
+		want time.Duration
+	}{
+		{`5000000000`, 5 * time.Second},
+		{`"5s"`, 5 * time.Second},
+		{`"1m30s"`, 90 * time.Second},
+		{`" 2h "`, 2 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		var d Duration
+		if err := json.Unmarshal([]byte(tt.data), &d); err != nil {
+			t.Errorf("could not unmarshal '%s': %s\n", tt.data, err)
+			continue
+		}
+		if d.Duration() != tt.want {
+			t.Errorf(errFmtString, tt.want, d.Duration())
+		}
+	}
+
+	var d Duration
+	if err := json.Unmarshal([]byte(`"5 minutes"`), &d); err == nil {
+		t.Errorf("want: error for '5 minutes'; got: nil\n")
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	botCon := BotConfig{
+		Name:            "bot_name",
+		TimeInterval:    Duration(5 * time.Minute),
+		ChatAdminConfig: &ChatAdminConfig{Name: "admin_name"},
+		ChatConfigs: []ChatConfig{
+			{Name: "chat_1", SelectiveProcs: []SelectiveProc{
+				{Name: "Test1", TemplatePath: "./templates/template_fmt.txt", RegistryPath: "./r1.json", Url: "https://www.aemet.es/1"},
+			}},
+		},
+	}
+
+	for _, ext := range []string{".json", ".yaml", ".yml", ".toml"} {
+		t.Run(ext, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "botConfig"+ext)
+			if err := botCon.WriteFile(path); err != nil {
+				t.Fatalf("could not write config: %s\n", err)
+			}
+
+			data, _ := os.ReadFile(path)
+			if !strings.Contains(string(data), "5m0s") {
+				t.Errorf("want: TimeInterval written as '5m0s'; got:\n%s\n", data)
+			}
+
+			var read BotConfig
+			if err := read.ReadFile(path); err != nil {
+				t.Fatalf("could not read config: %s\n", err)
+			}
+			if read.TimeInterval != botCon.TimeInterval {
+				t.Errorf(errFmtString, botCon.TimeInterval, read.TimeInterval)
+			}
+			if read.ChatConfigs[0].SelectiveProcs[0] != botCon.ChatConfigs[0].SelectiveProcs[0] {
+				t.Errorf("want: %+v; got: %+v\n", botCon.ChatConfigs[0].SelectiveProcs[0], read.ChatConfigs[0].SelectiveProcs[0])
+			}
+		})
+	}
+
+	for _, name := range []string{"botConfig.conf", "config"} {
+		t.Run("DefaultJSON_"+name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), name)
+			if err := botCon.WriteFile(path); err != nil {
+				t.Fatalf("could not write config: %s\n", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil || !json.Valid(data) {
+				t.Errorf("want: config written as JSON; got:\n%s (%v)\n", data, err)
+			}
+
+			var read BotConfig
+			if err := read.ReadFile(path); err != nil {
+				t.Fatalf("could not read config: %s\n", err)
+			}
+			if read.TimeInterval != botCon.TimeInterval {
+				t.Errorf(errFmtString, botCon.TimeInterval, read.TimeInterval)
+			}
+		})
+	}
+}
+
+func TestConfigToJSONUnknownFields(t *testing.T) {
+	yamlData := "Name: bot\nTimeInterval: 5m\nInterval: 5m\n"
+
+	data, err := configToJSON([]byte(yamlData), YAML_FORMAT)
+	if err != nil {
+		t.Fatalf("could not convert YAML: %s\n", err)
+	}
+
+	var bc BotConfig
+	var problems configProblems
+	decodeConfig(data, &bc, &problems)
+	if len(problems.Problems) != 1 || problems.Problems[0].Field != "Interval" {
+		t.Errorf("want: problem in 'Interval'; got: '%s'\n", problems.Error())
+	}
+	if bc.TimeInterval.Duration() != 5*time.Minute {
+		t.Errorf(errFmtString, 5*time.Minute, bc.TimeInterval)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// lockedWriter lets the chats of a round, processed concurrently, write
+// their messages whole.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// writeDryRun writes the message the chat would get for the pdf or, if the
+// pdf would only be registered, its name.
+func writeDryRun(w io.Writer, c *ChatConfig, sp *SelectiveProc, template string, pdf PDF, send bool) {
+	if !send {
+		fmt.Fprintf(w, "=== %s/%s: %s (registered, not sent)\n", c.Name, sp.Name, pdf.Name)
+		return
+	}
+	fmt.Fprintf(w, "=== %s/%s: %s\n%s\n\n", c.Name, sp.Name, pdf.Name, strings.TrimRight(formatPDFMessage(template, sp, pdf), "\n"))
+}
+
+// handle_dry_run_command runs a round of every bot, fetching the pages and
+// rendering the messages of the new pdfs, without writing the registries or
+// connecting to Telegram. The messages, or with send off the pdfs init would
+// register, are written to output, stdout if empty. chatName and procName
+// select the selective processes like in init.
+func handle_dry_run_command(configPaths []string, send bool, output, chatName, procName string) {
+	var configs []*BotConfig
+	for _, path := range configPaths {
+		// no secrets are needed, nothing is sent
+		bc, err := readConfigLayout(path)
+		if err == nil {
+			err = validateConfig(bc)
+		}
+		if err != nil {
+			fmt.Println(err)
+			exitf(-1, "Invalid bot configuration '%s'", path)
+		}
+		configs = append(configs, bc)
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			exitf(-1, "Could not create dry run output: %s", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	dryRun := &lockedWriter{w: w}
+
+	var total procStats
+	procs := 0
+	for _, bc := range configs {
+		opts := roundOptions{send: send, dryRun: dryRun, bot: bc.Name}
+		errCh := make(chan *ProcessingError)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for pe := range errCh {
+				fmt.Fprintf(opts.dryRun, "!!! %s\n", pe.Error())
+			}
+		}()
+
+		summary := processChats(nil, selectChats(bc.ChatConfigs, chatName, procName), errCh, opts)
+		close(errCh)
+		<-done
+		total.Add(summary.procStats)
+		procs += summary.Procs
+	}
+	if procs == 0 {
+		exitf(-1, "No selective process matches --chat='%s' --proc='%s'", chatName, procName)
+	}
+
+	verb := "sent"
+	if !send {
+		verb = "registered"
+	}
+	fmt.Printf("[INFO] Dry run: %d pages fetched, %d pdfs found, %d would be %s, %d errors. Nothing was written or sent\n",
+		total.PagesFetched, total.PDFsFound, total.NewPDFs, verb, total.Errors)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default error aggregation settings, see ErrorsConfig.
+const (
+	DEFAULT_ERROR_WINDOW         = time.Hour
+	DEFAULT_RESOLVE_AFTER_ROUNDS = 3
+)
+
+// ErrorsConfig sets which errors are sent to the admin chats and the error
+// sinks and how they are aggregated, see error_policy.go for the filtering.
+type ErrorsConfig struct {
+	Window       Duration          `json:",omitempty"` // repeats are rolled up once per window, default 1h
+	ResolveAfter Duration          `json:",omitempty"` // without repeats before an error is resolved, default 3 TimeIntervals
+	Severities   map[string]string `json:",omitempty"` // error code to severity, overriding the defaults
+	MinSeverity  string            `json:",omitempty"` // errors below it are not sent, default info
+	Mutes        []MuteRule        `json:",omitempty"` // errors not sent until a time, set with /mute
+	Sinks        []ErrorSinkConfig `json:",omitempty"` // where else the alerts are sent, see error_sinks.go
+}
+
+func (bc *BotConfig) errorWindow() time.Duration {
+	if bc.Errors != nil && bc.Errors.Window > 0 {
+		return bc.Errors.Window.Duration()
+	}
+	return DEFAULT_ERROR_WINDOW
+}
+
+func (bc *BotConfig) errorResolveAfter() time.Duration {
+	if bc.Errors != nil && bc.Errors.ResolveAfter > 0 {
+		return bc.Errors.ResolveAfter.Duration()
+	}
+	return DEFAULT_RESOLVE_AFTER_ROUNDS * bc.TimeInterval.Duration()
+}
+
+type errorKey struct {
+	Code ProcessingErrorCode
+	Chat string
+	Proc string
+}
+
+type errorGroup struct {
+	first      *ProcessingError
+	firstSeen  time.Time
+	lastSeen   time.Time
+	lastNotice time.Time
+	total      int
+	suppressed int // repeats since lastNotice
+}
+
+// errorAggregator groups the errors by code, chat and selective process. The
+// first error of a group is sent right away, its repeats are rolled up once
+// per window and a notice is sent when it stops happening.
+type errorAggregator struct {
+	groups map[errorKey]*errorGroup
+}
+
+func newErrorAggregator() *errorAggregator {
+	return &errorAggregator{groups: map[errorKey]*errorGroup{}}
+}
+
+// Kinds of the alerts sent about the errors.
+type alertKind int
+
+const (
+	NewErrorAlert alertKind = iota
+	RollupAlert
+	ResolvedAlert
+)
+
+var alertKindToString = map[alertKind]string{
+	NewErrorAlert: "error",
+	RollupAlert:   "rollup",
+	ResolvedAlert: "resolved",
+}
+
+func (k alertKind) String() string {
+	return alertKindToString[k]
+}
+
+// errorAlert is what is sent to the admin chats and the error sinks about a
+// group of errors: its first error, the rollup of its repeats or its
+// resolution.
+type errorAlert struct {
+	Kind      alertKind
+	Bot       string
+	Error     *ProcessingError // first error of the group
+	Count     int              // repeats rolled up, or times seen once resolved
+	Period    time.Duration    // of the rollup, or without repeats once resolved
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Add records the error and returns the alert to send now, if any.
+func (ea *errorAggregator) Add(pe *ProcessingError, now time.Time) (*errorAlert, bool) {
+	key := errorKey{pe.Code, pe.Chat, pe.Proc}
+
+	group, ok := ea.groups[key]
+	if !ok {
+		ea.groups[key] = &errorGroup{
+			first:      pe,
+			firstSeen:  now,
+			lastSeen:   now,
+			lastNotice: now,
+			total:      1,
+		}
+		return &errorAlert{Kind: NewErrorAlert, Error: pe, Count: 1, FirstSeen: now, LastSeen: now}, true
+	}
+
+	group.lastSeen = now
+	group.total++
+	group.suppressed++
+	return nil, false
+}
+
+// Flush returns the rollups of the groups whose window is over and the
+// resolutions of the errors not seen for resolveAfter, in a stable order.
+func (ea *errorAggregator) Flush(now time.Time, window, resolveAfter time.Duration) []*errorAlert {
+	keys := make([]errorKey, 0, len(ea.groups))
+	for key := range ea.groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Chat != keys[j].Chat {
+			return keys[i].Chat < keys[j].Chat
+		}
+		if keys[i].Proc != keys[j].Proc {
+			return keys[i].Proc < keys[j].Proc
+		}
+		return keys[i].Code < keys[j].Code
+	})
+
+	var alerts []*errorAlert
+	for _, key := range keys {
+		group := ea.groups[key]
+
+		resolved := now.Sub(group.lastSeen) >= resolveAfter
+		if group.suppressed > 0 && (resolved || now.Sub(group.lastNotice) >= window) {
+			alerts = append(alerts, group.alert(RollupAlert, group.suppressed, now.Sub(group.lastNotice)))
+			group.suppressed = 0
+			group.lastNotice = now
+		}
+
+		if resolved {
+			alerts = append(alerts, group.alert(ResolvedAlert, group.total, now.Sub(group.lastSeen)))
+			delete(ea.groups, key)
+		}
+	}
+
+	return alerts
+}
+
+func (group *errorGroup) alert(kind alertKind, count int, period time.Duration) *errorAlert {
+	return &errorAlert{
+		Kind:      kind,
+		Error:     group.first,
+		Count:     count,
+		Period:    period,
+		FirstSeen: group.firstSeen,
+		LastSeen:  group.lastSeen,
+	}
+}
+
+// shortDuration formats d rounded to minutes, without zero units: 4h, 1h30m.
+func shortDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+
+	s := d.Round(time.Minute).String()
+	s = strings.TrimSuffix(s, "0s")
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+func (a *errorAlert) seen() string {
+	if a.Count > 1 {
+		return fmt.Sprintf("seen %d times in %s", a.Count, shortDuration(a.LastSeen.Sub(a.FirstSeen)))
+	}
+	return "seen once"
+}
+
+// HTML renders the alert for the admin chats.
+func (a *errorAlert) HTML() string {
+	switch a.Kind {
+	case RollupAlert:
+		format := "Error: <strong>%s</strong> x %d in the last %s\n" +
+			"  - chat name: <i>%s</i>\n" +
+			"  - proc name: <i>%s</i>\n" +
+			"  - last seen: %s\n"
+
+		return fmt.Sprintf(format,
+			a.Error.Code,
+			a.Count,
+			shortDuration(a.Period),
+			html.EscapeString(a.Error.Chat),
+			html.EscapeString(a.Error.Proc),
+			a.LastSeen.UTC().Format(time.RFC3339),
+		)
+	case ResolvedAlert:
+		format := "Resolved: <strong>%s</strong>, not seen for %s\n" +
+			"  - chat name: <i>%s</i>\n" +
+			"  - proc name: <i>%s</i>\n" +
+			"  - %s\n"
+
+		return fmt.Sprintf(format,
+			a.Error.Code,
+			shortDuration(a.Period),
+			html.EscapeString(a.Error.Chat),
+			html.EscapeString(a.Error.Proc),
+			a.seen(),
+		)
+	}
+	return a.Error.HTML()
+}
+
+// Text renders the alert as plain text.
+func (a *errorAlert) Text() string {
+	switch a.Kind {
+	case RollupAlert:
+		return fmt.Sprintf("Error: %s x %d in the last %s\n  - chat name: %s\n  - proc name: %s\n  - last seen: %s\n",
+			a.Error.Code, a.Count, shortDuration(a.Period), a.Error.Chat, a.Error.Proc, a.LastSeen.UTC().Format(time.RFC3339))
+	case ResolvedAlert:
+		return fmt.Sprintf("Resolved: %s, not seen for %s\n  - chat name: %s\n  - proc name: %s\n  - %s\n",
+			a.Error.Code, shortDuration(a.Period), a.Error.Chat, a.Error.Proc, a.seen())
+	}
+	return a.Error.Text()
+}
+
+// Subject is a one line summary of the alert, e.g. for mail.
+func (a *errorAlert) Subject() string {
+	subject := fmt.Sprintf("%s: %s in %s/%s", a.Kind, a.Error.Code, a.Error.Chat, a.Error.Proc)
+	if a.Bot != "" {
+		subject = "[" + a.Bot + "] " + subject
+	}
+	return subject
+}
+
+func (a *errorAlert) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Kind      string
+		Bot       string `json:",omitempty"`
+		Error     *ProcessingError
+		Count     int
+		Period    Duration `json:",omitempty"`
+		FirstSeen time.Time
+		LastSeen  time.Time
+	}{a.Kind.String(), a.Bot, a.Error, a.Count, Duration(a.Period), a.FirstSeen, a.LastSeen})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorAggregator(t *testing.T) {
+	window, resolveAfter := 4*time.Hour, 15*time.Minute
+	start := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	templateErr := &ProcessingError{Code: ReadTemplateError, Chat: "chat_1", Proc: "Test1", Err: errors.New("no such file")}
+	urlErr := &ProcessingError{Code: GetUrlContentError, Chat: "chat_1", Proc: "Test1", Err: errors.New("timeout")}
+
+	ea := newErrorAggregator()
+
+	if alert, ok := ea.Add(templateErr, start); !ok || !strings.Contains(alert.HTML(), "ReadTemplateError") {
+		t.Fatalf("want: first error sent; got: %+v (%t)\n", alert, ok)
+	}
+	if _, ok := ea.Add(urlErr, start); !ok {
+		t.Errorf("want: first error of another code sent\n")
+	}
+
+	// the template error keeps happening every 5 minutes, the url one stops
+	now := start
+	for i := 0; i < 48; i++ {
+		now = now.Add(5 * time.Minute)
+		if _, ok := ea.Add(templateErr, now); ok {
+			t.Fatalf("want: repeat %d suppressed\n", i)
+		}
+
+		messages := alertsHTML(ea.Flush(now, window, resolveAfter))
+		switch {
+		case now.Sub(start) == resolveAfter:
+			if len(messages) != 1 || !strings.HasPrefix(messages[0], "Resolved: <strong>GetUrlContentError</strong>") {
+				t.Errorf("want: url error resolved; got: %q\n", messages)
+			}
+		case now.Sub(start) == window:
+			want := "Error: <strong>ReadTemplateError</strong> x 48 in the last 4h\n"
+			if len(messages) != 1 || !strings.HasPrefix(messages[0], want) {
+				t.Errorf("want: '%s'; got: %q\n", want, messages)
+			}
+		case len(messages) != 0:
+			t.Errorf("want: no messages at %s; got: %q\n", now.Sub(start), messages)
+		}
+	}
+
+	// the template error stops: one more repeat is rolled up before resolving
+	ea.Add(templateErr, now.Add(time.Minute))
+	messages := alertsHTML(ea.Flush(now.Add(time.Minute+resolveAfter), window, resolveAfter))
+	if len(messages) != 2 || !strings.Contains(messages[0], "x 1 in the last") || !strings.Contains(messages[1], "seen 50 times in 4h1m") {
+		t.Errorf("want: rollup and resolved notice; got: %q\n", messages)
+	}
+
+	if _, ok := ea.Add(templateErr, now.Add(time.Hour)); !ok {
+		t.Errorf("want: error sent again after being resolved\n")
+	}
+}
+
+func alertsHTML(alerts []*errorAlert) []string {
+	var messages []string
+	for _, alert := range alerts {
+		messages = append(messages, alert.HTML())
+	}
+	return messages
+}
+
+func TestShortDuration(t *testing.T) {
+	var tests = []struct {
+		d    time.Duration
+		want string
+	}{
+		{4 * time.Hour, "4h"},
+		{90 * time.Minute, "1h30m"},
+		{5*time.Minute + 20*time.Second, "5m"},
+		{42 * time.Second, "42s"},
+	}
+
+	for _, tt := range tests {
+		if got := shortDuration(tt.d); got != tt.want {
+			t.Errorf(errFmtString, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"html"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Severity int
+
+const (
+	InfoSeverity Severity = iota
+	WarningSeverity
+	ErrorSeverity
+	CriticalSeverity
+)
+
+var severityToString = map[Severity]string{
+	InfoSeverity:     "info",
+	WarningSeverity:  "warning",
+	ErrorSeverity:    "error",
+	CriticalSeverity: "critical",
+}
+
+func (s Severity) String() string {
+	return severityToString[s]
+}
+
+func parseSeverity(s string) (Severity, bool) {
+	for severity, name := range severityToString {
+		if strings.EqualFold(name, s) {
+			return severity, true
+		}
+	}
+	return InfoSeverity, false
+}
+
+// Severity of each error code unless set in ErrorsConfig.Severities. Pages
+// that cannot be fetched and registries not created yet are usually
+// transient.
+var defaultSeverities = map[ProcessingErrorCode]Severity{
+	SendMessageError:       ErrorSeverity,
+	ReadTemplateError:      ErrorSeverity,
+	ReadRegistryError:      WarningSeverity,
+	WriteRegistryError:     CriticalSeverity,
+	UnmarshalRegistryError: CriticalSeverity,
+	MarshalRegistryError:   CriticalSeverity,
+	GetUrlContentError:     WarningSeverity,
+	BlankPDFDateError:      InfoSeverity,
+}
+
+// MuteRule keeps the errors matching it from the admin chats until it
+// expires. Empty fields match anything.
+type MuteRule struct {
+	Code  string `json:",omitempty"`
+	Chat  string `json:",omitempty"`
+	Proc  string `json:",omitempty"`
+	Until time.Time
+}
+
+func (m *MuteRule) Matches(pe *ProcessingError, now time.Time) bool {
+	return now.Before(m.Until) &&
+		(m.Code == "" || strings.EqualFold(m.Code, pe.Code.String())) &&
+		(m.Chat == "" || strings.EqualFold(m.Chat, pe.Chat)) &&
+		(m.Proc == "" || strings.EqualFold(m.Proc, pe.Proc))
+}
+
+func (m *MuteRule) sameTarget(other *MuteRule) bool {
+	return strings.EqualFold(m.Code, other.Code) &&
+		strings.EqualFold(m.Chat, other.Chat) &&
+		strings.EqualFold(m.Proc, other.Proc)
+}
+
+func (m *MuteRule) Format() string {
+	target := func(s string) string {
+		if s == "" {
+			return "all"
+		}
+		return html.EscapeString(s)
+	}
+	return fmt.Sprintf("<b>%s</b> chat: %s, proc: %s, until %s",
+		target(m.Code), target(m.Chat), target(m.Proc), m.Until.UTC().Format(time.RFC3339))
+}
+
+func (bc *BotConfig) severityOf(code ProcessingErrorCode) Severity {
+	if bc.Errors != nil {
+		for name, severity := range bc.Errors.Severities {
+			if strings.EqualFold(name, code.String()) {
+				if s, ok := parseSeverity(severity); ok {
+					return s
+				}
+			}
+		}
+	}
+	return defaultSeverities[code]
+}
+
+func (bc *BotConfig) minSeverity() Severity {
+	if bc.Errors != nil {
+		if s, ok := parseSeverity(bc.Errors.MinSeverity); ok {
+			return s
+		}
+	}
+	return InfoSeverity
+}
+
+// errorFiltered tells whether the error must not be sent to the admin chats:
+// its severity is below the minimum or it is muted.
+func (bc *BotConfig) errorFiltered(pe *ProcessingError, now time.Time) bool {
+	if bc.severityOf(pe.Code) < bc.minSeverity() {
+		return true
+	}
+
+	if bc.Errors != nil {
+		for i := range bc.Errors.Mutes {
+			if bc.Errors.Mutes[i].Matches(pe, now) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkErrorsConfig reports the problems of the error policy. Mute rules are
+// written by /mute, so expired ones are ignored and those for chats or
+// selective processes removed since are only logged.
+func checkErrorsConfig(bc *BotConfig, problems *configProblems) {
+	ec := bc.Errors
+
+	if ec.Window < 0 {
+		problems.Add("Errors.Window", "must not be negative, got %s", ec.Window)
+	}
+	if ec.ResolveAfter < 0 {
+		problems.Add("Errors.ResolveAfter", "must not be negative, got %s", ec.ResolveAfter)
+	} else if ec.ResolveAfter > 0 && ec.ResolveAfter < bc.TimeInterval {
+		problems.Add("Errors.ResolveAfter", "%s is shorter than TimeInterval %s, errors would be resolved between rounds", ec.ResolveAfter, bc.TimeInterval)
+	}
+
+	if _, ok := parseSeverity(ec.MinSeverity); ec.MinSeverity != "" && !ok {
+		problems.Add("Errors.MinSeverity", "unknown severity '%s', use info, warning, error or critical", ec.MinSeverity)
+	}
+
+	codes := make([]string, 0, len(ec.Severities))
+	for code := range ec.Severities {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		if _, ok := parseErrorCode(code); !ok {
+			problems.Add("Errors.Severities."+code, "unknown error code")
+		}
+		if _, ok := parseSeverity(ec.Severities[code]); !ok {
+			problems.Add("Errors.Severities."+code, "unknown severity '%s', use info, warning, error or critical", ec.Severities[code])
+		}
+	}
+
+	now := time.Now()
+	for i, m := range ec.Mutes {
+		field := fmt.Sprintf("Errors.Mutes[%d]", i)
+		if m.Until.IsZero() {
+			problems.Add(field+".Until", "must be set")
+		} else if !now.Before(m.Until) {
+			continue
+		}
+		if _, ok := parseErrorCode(m.Code); m.Code != "" && !ok {
+			problems.Add(field+".Code", "unknown error code '%s'", m.Code)
+		}
+		if err := bc.checkMuteTarget(&m); err != nil {
+			slog.Warn("Mute rule never matches", "field", field, "error", err)
+		}
+	}
+
+	for i := range ec.Sinks {
+		checkErrorSink(&ec.Sinks[i], fmt.Sprintf("Errors.Sinks[%d]", i), problems)
+	}
+}
+
+// checkMuteTarget reports whether the chat and selective process of the rule
+// exist. A proc without chat may be in any chat.
+func (bc *BotConfig) checkMuteTarget(m *MuteRule) error {
+	if m.Chat != "" {
+		chat := bc.findChat(m.Chat)
+		if chat == nil {
+			return fmt.Errorf("unknown chat '%s'", m.Chat)
+		}
+		if m.Proc != "" && chat.findProc(m.Proc) < 0 {
+			return fmt.Errorf("unknown selective process '%s' in chat '%s'", m.Proc, m.Chat)
+		}
+		return nil
+	}
+	if m.Proc != "" {
+		for i := range bc.ChatConfigs {
+			if bc.ChatConfigs[i].findProc(m.Proc) >= 0 {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown selective process '%s'", m.Proc)
+	}
+	return nil
+}
+
+// pruneMutes removes the mute rules expired at now and those for chats or
+// selective processes no longer in bc.
+func pruneMutes(bc *BotConfig, now time.Time) {
+	if bc.Errors == nil {
+		return
+	}
+	bc.Errors.Mutes = slices.DeleteFunc(bc.Errors.Mutes, func(m MuteRule) bool {
+		return !now.Before(m.Until) || bc.checkMuteTarget(&m) != nil
+	})
+}
+
+// errorsConfigOf returns the error policy of bc, creating it if needed.
+func errorsConfigOf(bc *BotConfig) *ErrorsConfig {
+	if bc.Errors == nil {
+		bc.Errors = &ErrorsConfig{}
+	}
+	return bc.Errors
+}
+
+// parseMuteTarget reads the optional '[chat [proc]]' arguments of /mute and
+// /unmute after the code, 'all' matching any code.
+func parseMuteTarget(args []string) (MuteRule, error) {
+	var m MuteRule
+	if !strings.EqualFold(args[0], "all") {
+		code, ok := parseErrorCode(args[0])
+		if !ok {
+			return m, fmt.Errorf("unknown error code '%s'", args[0])
+		}
+		m.Code = code.String()
+	}
+	if len(args) > 1 {
+		m.Chat = args[1]
+	}
+	if len(args) > 2 {
+		m.Proc = args[2]
+	}
+	return m, nil
+}
+
+func handleErrors(c tele.Context, lc *liveConfig) error {
+	bc := lc.Get()
+	now := time.Now()
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "Minimum severity: <b>%s</b>\n\nSeverities:\n", bc.minSeverity())
+	codes := make([]ProcessingErrorCode, 0, len(errorCodes))
+	for code := range errorCodes {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&msg, "  - %s: %s\n", code, bc.severityOf(code))
+	}
+
+	msg.WriteString("\nMutes:\n")
+	n_mutes := 0
+	if bc.Errors != nil {
+		for _, m := range bc.Errors.Mutes {
+			if now.Before(m.Until) {
+				fmt.Fprintf(&msg, "  - %s\n", m.Format())
+				n_mutes++
+			}
+		}
+	}
+	if n_mutes == 0 {
+		msg.WriteString("  none\n")
+	}
+
+	return sendHTML(c, "/errors", "%s", msg.String())
+}
+
+func handleMute(c tele.Context, lc *liveConfig) error {
+	args := queryArgs(c)
+	if len(args) < 2 || len(args) > 4 {
+		return sendHTML(c, "/mute", "Usage: <code>/mute &lt;code|all&gt; &lt;duration&gt; [chat [proc]]</code>")
+	}
+
+	d, err := time.ParseDuration(args[1])
+	if err != nil || d <= 0 {
+		return sendHTML(c, "/mute", "Invalid duration '%s', use e.g. 30m or 2h", html.EscapeString(args[1]))
+	}
+	mute, err := parseMuteTarget(append(args[:1:1], args[2:]...))
+	if err != nil {
+		return sendHTML(c, "/mute", "%s", html.EscapeString(err.Error()))
+	}
+	now := time.Now()
+	mute.Until = now.Add(d).UTC().Truncate(time.Second)
+
+	err = lc.Update(func(bc *BotConfig) error {
+		if err := bc.checkMuteTarget(&mute); err != nil {
+			return err
+		}
+
+		// the previous rule for the same errors is replaced
+		pruneMutes(bc, now)
+		ec := errorsConfigOf(bc)
+		ec.Mutes = slices.DeleteFunc(ec.Mutes, func(m MuteRule) bool { return m.sameTarget(&mute) })
+		ec.Mutes = append(ec.Mutes, mute)
+		return nil
+	})
+	if err != nil {
+		return sendHTML(c, "/mute", "Could not mute errors: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	return sendHTML(c, "/mute", "Muted %s", mute.Format())
+}
+
+func handleUnmute(c tele.Context, lc *liveConfig) error {
+	args := queryArgs(c)
+	if len(args) < 1 || len(args) > 3 {
+		return sendHTML(c, "/unmute", "Usage: <code>/unmute &lt;code|all&gt; [chat [proc]]</code>")
+	}
+
+	target, err := parseMuteTarget(args)
+	if err != nil {
+		return sendHTML(c, "/unmute", "%s", html.EscapeString(err.Error()))
+	}
+
+	removed := 0
+	err = lc.Update(func(bc *BotConfig) error {
+		ec := errorsConfigOf(bc)
+		n := len(ec.Mutes)
+		ec.Mutes = slices.DeleteFunc(ec.Mutes, func(m MuteRule) bool { return m.sameTarget(&target) })
+		removed = n - len(ec.Mutes)
+		return nil
+	})
+	if err != nil {
+		return sendHTML(c, "/unmute", "Could not unmute errors: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+	if removed == 0 {
+		return sendHTML(c, "/unmute", "No mute rule for those errors")
+	}
+
+	return sendHTML(c, "/unmute", "Unmuted %d rule(s)", removed)
+}
+
+func handleSeverity(c tele.Context, lc *liveConfig) error {
+	args := queryArgs(c)
+	if len(args) != 2 {
+		return sendHTML(c, "/severity", "Usage: <code>/severity &lt;code&gt; &lt;info|warning|error|critical&gt;</code>")
+	}
+
+	code, ok := parseErrorCode(args[0])
+	if !ok {
+		return sendHTML(c, "/severity", "Unknown error code '%s'", html.EscapeString(args[0]))
+	}
+	severity, ok := parseSeverity(args[1])
+	if !ok {
+		return sendHTML(c, "/severity", "Unknown severity '%s'", html.EscapeString(args[1]))
+	}
+
+	err := lc.Update(func(bc *BotConfig) error {
+		ec := errorsConfigOf(bc)
+		if ec.Severities == nil {
+			ec.Severities = map[string]string{}
+		}
+		ec.Severities[code.String()] = severity.String()
+		return nil
+	})
+	if err != nil {
+		return sendHTML(c, "/severity", "Could not set severity: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	return sendHTML(c, "/severity", "Severity of <b>%s</b> set to <b>%s</b>", code, severity)
+}
+
+func handleMinSeverity(c tele.Context, lc *liveConfig) error {
+	args := queryArgs(c)
+	if len(args) != 1 {
+		return sendHTML(c, "/min_severity", "Usage: <code>/min_severity &lt;info|warning|error|critical&gt;</code>")
+	}
+
+	severity, ok := parseSeverity(args[0])
+	if !ok {
+		return sendHTML(c, "/min_severity", "Unknown severity '%s'", html.EscapeString(args[0]))
+	}
+
+	err := lc.Update(func(bc *BotConfig) error {
+		errorsConfigOf(bc).MinSeverity = severity.String()
+		return nil
+	})
+	if err != nil {
+		return sendHTML(c, "/min_severity", "Could not set minimum severity: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	return sendHTML(c, "/min_severity", "Only errors of severity <b>%s</b> or higher are sent", severity)
+}
+
+func registerErrorHandlers(bot *tele.Bot, lc *liveConfig) {
+	bot.Handle("/errors", func(c tele.Context) error { return handleErrors(c, lc) })
+	bot.Handle("/mute", func(c tele.Context) error { return handleMute(c, lc) })
+	bot.Handle("/unmute", func(c tele.Context) error { return handleUnmute(c, lc) })
+	bot.Handle("/severity", func(c tele.Context) error { return handleSeverity(c, lc) })
+	bot.Handle("/min_severity", func(c tele.Context) error { return handleMinSeverity(c, lc) })
+}
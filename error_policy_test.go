@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestErrorFiltered(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	bc := BotConfig{
+		ChatConfigs: []ChatConfig{{Name: "chat_1", SelectiveProcs: []SelectiveProc{{Name: "Test1"}, {Name: "Test2"}}}},
+		Errors: &ErrorsConfig{
+			Severities:  map[string]string{"readtemplateerror": "critical", "SendMessageError": "info"},
+			MinSeverity: "warning",
+			Mutes: []MuteRule{
+				{Code: "GetUrlContentError", Chat: "chat_1", Proc: "Test1", Until: now.Add(time.Hour)},
+				{Code: "WriteRegistryError", Until: now.Add(-time.Minute)},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		msg      ProcessingError
+		filtered bool
+	}{
+		{"Severity override", ProcessingError{Code: ReadTemplateError, Chat: "chat_1", Proc: "Test1"}, false},
+		{"Below minimum", ProcessingError{Code: SendMessageError, Chat: "chat_1", Proc: "Test1"}, true},
+		{"Default below minimum", ProcessingError{Code: BlankPDFDateError, Chat: "chat_1", Proc: "Test1"}, true},
+		{"Muted", ProcessingError{Code: GetUrlContentError, Chat: "CHAT_1", Proc: "test1"}, true},
+		{"Other proc", ProcessingError{Code: GetUrlContentError, Chat: "chat_1", Proc: "Test2"}, false},
+		{"Mute expired", ProcessingError{Code: WriteRegistryError, Chat: "chat_1", Proc: "Test1"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.msg.Err = errors.New("error")
+			if got := bc.errorFiltered(&test.msg, now); got != test.filtered {
+				t.Errorf("want: filtered %t; got: %t\n", test.filtered, got)
+			}
+		})
+	}
+
+	if (&BotConfig{}).errorFiltered(&ProcessingError{Code: BlankPDFDateError}, now) {
+		t.Errorf("want: every error sent without policy\n")
+	}
+}
+
+func TestCheckErrorsConfig(t *testing.T) {
+	bc := BotConfig{
+		TimeInterval: Duration(5 * time.Minute),
+		ChatConfigs:  []ChatConfig{{Name: "chat_1", SelectiveProcs: []SelectiveProc{{Name: "Test1"}}}},
+		Errors: &ErrorsConfig{
+			Severities:  map[string]string{"NoSuchError": "error", "SendMessageError": "fatal"},
+			MinSeverity: "debug",
+			Mutes: []MuteRule{
+				{Code: "GetUrlContentError", Chat: "chat_1", Proc: "Test1", Until: time.Now().Add(time.Hour)},
+				{Code: "Nope", Chat: "chat_2", Until: time.Now().Add(time.Hour)},
+				{Proc: "Test2"},
+				{Code: "Expired", Proc: "Test3", Until: time.Now().Add(-time.Hour)},
+			},
+		},
+	}
+
+	var problems configProblems
+	checkErrorsConfig(&bc, &problems)
+
+	want := []string{
+		"Errors.MinSeverity",
+		"Errors.Severities.NoSuchError",
+		"Errors.Severities.SendMessageError",
+		"Errors.Mutes[1].Code",
+		"Errors.Mutes[2].Until",
+	}
+	if len(problems.Problems) != len(want) {
+		t.Fatalf("want: %d problems; got: %v\n", len(want), problems.Problems)
+	}
+	for i, field := range want {
+		if problems.Problems[i].Field != field {
+			t.Errorf("want: problem %d at '%s'; got: %+v\n", i, field, problems.Problems[i])
+		}
+	}
+}
+
+func TestPruneMutes(t *testing.T) {
+	now := time.Now()
+	bc := BotConfig{
+		ChatConfigs: []ChatConfig{{Name: "chat_1", SelectiveProcs: []SelectiveProc{{Name: "Test1"}}}},
+		Errors: &ErrorsConfig{Mutes: []MuteRule{
+			{Chat: "chat_1", Proc: "Test1", Until: now.Add(time.Hour)},
+			{Chat: "chat_1", Until: now.Add(-time.Hour)},
+			{Chat: "chat_1", Proc: "Test2", Until: now.Add(time.Hour)},
+			{Proc: "Test2", Until: now.Add(time.Hour)},
+			{Code: "GetUrlContentError", Until: now.Add(time.Hour)},
+		}},
+	}
+
+	pruneMutes(&bc, now)
+	mutes := bc.Errors.Mutes
+	if len(mutes) != 2 || mutes[0].Proc != "Test1" || mutes[1].Code != "GetUrlContentError" {
+		t.Errorf("want: only the active rules with known targets; got: %+v\n", mutes)
+	}
+
+	var problems configProblems
+	checkErrorsConfig(&bc, &problems)
+	if len(problems.Problems) != 0 {
+		t.Errorf("want: no problems after pruning; got: %v\n", problems.Problems)
+	}
+}
+
+func TestParseMuteTarget(t *testing.T) {
+	m, err := parseMuteTarget([]string{"geturlcontenterror", "chat_1", "Test1"})
+	if err != nil || m != (MuteRule{Code: "GetUrlContentError", Chat: "chat_1", Proc: "Test1"}) {
+		t.Errorf("want: code, chat and proc; got: %+v (%v)\n", m, err)
+	}
+
+	m, err = parseMuteTarget([]string{"ALL"})
+	if err != nil || m != (MuteRule{}) {
+		t.Errorf("want: rule matching every error; got: %+v (%v)\n", m, err)
+	}
+
+	if _, err = parseMuteTarget([]string{"NoSuchError"}); err == nil {
+		t.Errorf("want: unknown code rejected\n")
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of error sinks.
+const (
+	STDERR_SINK  = "stderr"
+	FILE_SINK    = "file"
+	WEBHOOK_SINK = "webhook"
+	SMTP_SINK    = "smtp"
+)
+
+// Timeout of the deliveries to webhook and smtp sinks.
+const SINK_TIMEOUT = 10 * time.Second
+
+// Alerts waiting to be sent to a webhook or smtp sink. Once its queue is full,
+// new alerts for the sink are dropped.
+const SINK_QUEUE_SIZE = 100
+
+// ErrorSinkConfig is a destination of the error alerts besides the admin
+// chats, so errors still reach the admins while Telegram is failing. The
+// Errors.MinSeverity and mutes only apply to the admin chats; each sink has
+// its own filter.
+type ErrorSinkConfig struct {
+	Type        string      // stderr, file, webhook or smtp
+	MinSeverity string      `json:",omitempty"` // alerts below it are not sent, default info
+	Codes       []string    `json:",omitempty"` // only alerts of these error codes, all by default
+	Format      string      `json:",omitempty"` // stderr and file: text (default) or json
+	Path        string      `json:",omitempty"` // file: appended to
+	Url         string      `json:",omitempty"` // webhook: receives the alerts as a JSON POST
+	Headers     []string    `json:",omitempty"` // webhook: "Name: value", e.g. "Authorization: Bearer ${TOKEN}"
+	SMTP        *SMTPConfig `json:",omitempty"` // smtp: server and addresses
+}
+
+// SMTPConfig is the server the alerts are mailed through. STARTTLS is used
+// when the server offers it.
+type SMTPConfig struct {
+	Address  string // host:port
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"` // e.g. ${SMTP_PASSWORD}
+	From     string
+	To       []string
+}
+
+func (sc *ErrorSinkConfig) clone() ErrorSinkConfig {
+	clone := *sc
+	clone.Codes = append([]string(nil), sc.Codes...)
+	clone.Headers = append([]string(nil), sc.Headers...)
+	if sc.SMTP != nil {
+		smtpConfig := *sc.SMTP
+		smtpConfig.To = append([]string(nil), sc.SMTP.To...)
+		clone.SMTP = &smtpConfig
+	}
+	return clone
+}
+
+func (sc *ErrorSinkConfig) String() string {
+	switch sc.Type {
+	case FILE_SINK:
+		return sc.Type + " " + sc.Path
+	case WEBHOOK_SINK:
+		if u, err := url.Parse(sc.Url); err == nil {
+			return sc.Type + " " + u.Host // the url may hold a token
+		}
+	case SMTP_SINK:
+		if sc.SMTP != nil {
+			return sc.Type + " " + sc.SMTP.Address
+		}
+	}
+	return sc.Type
+}
+
+// accepts tells whether the alerts about the error are sent to the sink.
+func (sc *ErrorSinkConfig) accepts(bc *BotConfig, pe *ProcessingError) bool {
+	if minSeverity, ok := parseSeverity(sc.MinSeverity); ok && bc.severityOf(pe.Code) < minSeverity {
+		return false
+	}
+	if len(sc.Codes) > 0 {
+		return slices.ContainsFunc(sc.Codes, func(code string) bool {
+			return strings.EqualFold(code, pe.Code.String())
+		})
+	}
+	return true
+}
+
+// checkErrorSink reports the problems of the sink at field.
+func checkErrorSink(sc *ErrorSinkConfig, field string, problems *configProblems) {
+	if _, ok := parseSeverity(sc.MinSeverity); sc.MinSeverity != "" && !ok {
+		problems.Add(field+".MinSeverity", "unknown severity '%s', use info, warning, error or critical", sc.MinSeverity)
+	}
+	for i, code := range sc.Codes {
+		if _, ok := parseErrorCode(code); !ok {
+			problems.Add(fmt.Sprintf("%s.Codes[%d]", field, i), "unknown error code '%s'", code)
+		}
+	}
+
+	switch strings.ToLower(sc.Format) {
+	case "", TEXT_LOG_FORMAT, JSON_LOG_FORMAT:
+	default:
+		problems.Add(field+".Format", "unknown format '%s', use text or json", sc.Format)
+	}
+
+	switch sc.Type {
+	case STDERR_SINK:
+	case FILE_SINK:
+		if sc.Path == "" {
+			problems.Add(field+".Path", "must be set for file sinks")
+		}
+	case WEBHOOK_SINK:
+		if u, err := url.Parse(sc.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems.Add(field+".Url", "must be an http or https url, got '%s'", sc.Url)
+		}
+		for i, header := range sc.Headers {
+			if name, _, ok := strings.Cut(header, ":"); !ok || strings.TrimSpace(name) == "" {
+				problems.Add(fmt.Sprintf("%s.Headers[%d]", field, i), "must be 'Name: value'")
+			}
+		}
+	case SMTP_SINK:
+		if sc.SMTP == nil {
+			problems.Add(field+".SMTP", "must be set for smtp sinks")
+			return
+		}
+		if _, port, err := net.SplitHostPort(sc.SMTP.Address); err != nil || port == "" {
+			problems.Add(field+".SMTP.Address", "must be host:port, got '%s'", sc.SMTP.Address)
+		}
+		if _, err := mail.ParseAddress(sc.SMTP.From); err != nil {
+			problems.Add(field+".SMTP.From", "invalid address '%s'", sc.SMTP.From)
+		}
+		if len(sc.SMTP.To) == 0 {
+			problems.Add(field+".SMTP.To", "must not be empty")
+		}
+		for i, to := range sc.SMTP.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				problems.Add(fmt.Sprintf("%s.SMTP.To[%d]", field, i), "invalid address '%s'", to)
+			}
+		}
+	default:
+		problems.Add(field+".Type", "unknown sink type '%s', use stderr, file, webhook or smtp", sc.Type)
+	}
+}
+
+type errorSink interface {
+	Send(alert *errorAlert) error
+}
+
+func newErrorSink(sc *ErrorSinkConfig) errorSink {
+	asJSON := strings.EqualFold(sc.Format, JSON_LOG_FORMAT)
+	switch sc.Type {
+	case FILE_SINK:
+		return &fileSink{path: sc.Path, asJSON: asJSON}
+	case WEBHOOK_SINK:
+		return &webhookSink{url: sc.Url, headers: sc.Headers}
+	case SMTP_SINK:
+		return &smtpSink{config: sc.SMTP}
+	}
+	return &writerSink{w: os.Stderr, asJSON: asJSON}
+}
+
+// formatAlert renders the alert as a JSON line or as text.
+func formatAlert(alert *errorAlert, asJSON bool) ([]byte, error) {
+	if !asJSON {
+		return []byte(alert.Subject() + "\n" + alert.Text()), nil
+	}
+	data, err := json.Marshal(alert)
+	return append(data, '\n'), err
+}
+
+type writerSink struct {
+	w      io.Writer
+	asJSON bool
+}
+
+func (s *writerSink) Send(alert *errorAlert) error {
+	data, err := formatAlert(alert, s.asJSON)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(data)
+	return err
+}
+
+type fileSink struct {
+	path   string
+	asJSON bool
+}
+
+func (s *fileSink) Send(alert *errorAlert) error {
+	data, err := formatAlert(alert, s.asJSON)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(data)
+	return err
+}
+
+type webhookSink struct {
+	url     string
+	headers []string
+}
+
+var webhookClient = &http.Client{Timeout: SINK_TIMEOUT}
+
+func (s *webhookSink) Send(alert *errorAlert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, header := range s.headers {
+		name, value, _ := strings.Cut(header, ":")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	res, err := webhookClient.Do(req)
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err // without the url, it may hold a token
+	} else if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return nil
+}
+
+type smtpSink struct {
+	config *SMTPConfig
+}
+
+// smtpMessage builds the mail of the alert.
+func smtpMessage(config *SMTPConfig, alert *errorAlert, now time.Time) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.To, ", "))
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(alert.Subject())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(alert.Text(), "\n", "\r\n"))
+	return msg.Bytes()
+}
+
+func (s *smtpSink) Send(alert *errorAlert) error {
+	host, _, err := net.SplitHostPort(s.config.Address)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", s.config.Address, SINK_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(SINK_TIMEOUT))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.config.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.config.Username, s.config.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	// the envelope takes bare addresses, without the display names
+	from, err := mail.ParseAddress(s.config.From)
+	if err != nil {
+		return err
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, to := range s.config.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		if err := c.Rcpt(addr.Address); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(smtpMessage(s.config, alert, time.Now())); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// adminSink sends the alerts to the admin chats of a bot.
+type adminSink struct {
+	bot    *tele.Bot
+	admins []ChatAdminConfig
+}
+
+func (s *adminSink) Send(alert *errorAlert) error {
+	var errs []error
+	for i := range s.admins {
+		if _, err := s.bot.Send(&s.admins[i], alert.HTML(), &tele.SendOptions{ParseMode: "HTML"}); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.admins[i].Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sinkQueue sends the alerts of the admin chats, webhook or smtp sink of a bot
+// from its own goroutine, so the scheduler never waits for the network.
+type sinkQueue struct {
+	bot     string // name of the bot the sink belongs to
+	alerts  chan *errorAlert
+	pending sync.WaitGroup
+}
+
+var (
+	sinkQueuesMu sync.Mutex
+	sinkQueues   = map[string]*sinkQueue{} // by bot and sink config, see sinkQueueKeys
+)
+
+// sinkQueueKeys returns the keys of the queues of the admin chats and the
+// webhook and smtp sinks of the bot. Keys hold the whole config of the sink,
+// so a reloaded sink gets a new queue.
+func sinkQueueKeys(bot *tele.Bot, bc *BotConfig) (admins string, sinks []string) {
+	chats, _ := json.Marshal(bc.allAdminChats())
+	admins = fmt.Sprintf("%s admins %p %s", bc.Name, bot, chats)
+	if bc.Errors != nil {
+		for i := range bc.Errors.Sinks {
+			key, _ := json.Marshal(&bc.Errors.Sinks[i])
+			sinks = append(sinks, fmt.Sprintf("%s sink %s", bc.Name, key))
+		}
+	}
+	return admins, sinks
+}
+
+// enqueueAlert queues the alert in the queue at key, starting it with the
+// sink built by newSink on first use.
+func enqueueAlert(bc *BotConfig, key, name string, newSink func() errorSink, alert *errorAlert) {
+	sinkQueuesMu.Lock()
+	defer sinkQueuesMu.Unlock()
+	q, ok := sinkQueues[key]
+	if !ok {
+		q = &sinkQueue{bot: bc.Name, alerts: make(chan *errorAlert, SINK_QUEUE_SIZE)}
+		sinkQueues[key] = q
+		go q.run(newSink(), name)
+	}
+	q.enqueue(alert, name)
+}
+
+// pruneSinkQueues stops the queues of the bot whose sinks are no longer in
+// its configuration, once they send the alerts already queued.
+func pruneSinkQueues(bot *tele.Bot, bc *BotConfig) {
+	admins, sinks := sinkQueueKeys(bot, bc)
+	live := map[string]bool{admins: true}
+	for _, key := range sinks {
+		live[key] = true
+	}
+
+	sinkQueuesMu.Lock()
+	defer sinkQueuesMu.Unlock()
+	for key, q := range sinkQueues {
+		if q.bot == bc.Name && !live[key] {
+			close(q.alerts)
+			delete(sinkQueues, key)
+		}
+	}
+}
+
+func (q *sinkQueue) run(sink errorSink, name string) {
+	for alert := range q.alerts {
+		if err := sink.Send(alert); err != nil {
+			slog.Error("Could not send alert to error sink", "sink", name, LOG_ERROR_CODE_KEY, alert.Error.Code.String(), "error", err)
+		}
+		q.pending.Done()
+	}
+}
+
+// enqueue queues the alert, dropping it if the queue is full.
+func (q *sinkQueue) enqueue(alert *errorAlert, name string) {
+	q.pending.Add(1)
+	select {
+	case q.alerts <- alert:
+	default:
+		q.pending.Done()
+		slog.Error("Error sink queue full, alert dropped", "sink", name, LOG_ERROR_CODE_KEY, alert.Error.Code.String())
+	}
+}
+
+// flushSinks waits for the queued alerts to be sent, for commands exiting
+// after a single round.
+func flushSinks() {
+	sinkQueuesMu.Lock()
+	queues := make([]*sinkQueue, 0, len(sinkQueues))
+	for _, q := range sinkQueues {
+		queues = append(queues, q)
+	}
+	sinkQueuesMu.Unlock()
+
+	for _, q := range queues {
+		q.pending.Wait()
+	}
+}
+
+// deliverAlert sends the alert to the admin chats, unless the error policy
+// filters it out, and to every sink accepting it. The admin chats, webhook and
+// smtp sinks are only queued, see sinkQueue; stderr and file sinks are written
+// right away.
+func deliverAlert(bot *tele.Bot, bc *BotConfig, alert *errorAlert, now time.Time) {
+	alert.Bot = bc.Name
+	admins, sinks := sinkQueueKeys(bot, bc)
+
+	if chats := bc.allAdminChats(); len(chats) > 0 && !bc.errorFiltered(alert.Error, now) {
+		newSink := func() errorSink {
+			sink := &adminSink{bot: bot}
+			for _, admin := range chats {
+				sink.admins = append(sink.admins, *admin)
+			}
+			return sink
+		}
+		enqueueAlert(bc, admins, "admin chats", newSink, alert)
+	}
+	if bc.Errors == nil {
+		return
+	}
+
+	for i := range bc.Errors.Sinks {
+		sc := &bc.Errors.Sinks[i]
+		if !sc.accepts(bc, alert.Error) {
+			continue
+		}
+
+		switch sc.Type {
+		case WEBHOOK_SINK, SMTP_SINK:
+			config := sc.clone()
+			newSink := func() errorSink { return newErrorSink(&config) }
+			enqueueAlert(bc, sinks[i], sc.String(), newSink, alert)
+		default:
+			if err := newErrorSink(sc).Send(alert); err != nil {
+				slog.Error("Could not send alert to error sink", "sink", sc.String(), LOG_ERROR_CODE_KEY, alert.Error.Code.String(), "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testAlert(code ProcessingErrorCode) *errorAlert {
+	now := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	pe := &ProcessingError{Code: code, Chat: "chat_1", Proc: "Test1", Err: errors.New("<boom>")}
+	return &errorAlert{Kind: NewErrorAlert, Bot: "bot_1", Error: pe, Count: 1, FirstSeen: now, LastSeen: now}
+}
+
+func TestErrorSinkAccepts(t *testing.T) {
+	bc := BotConfig{Errors: &ErrorsConfig{Severities: map[string]string{"SendMessageError": "critical"}}}
+
+	tests := []struct {
+		name   string
+		sink   ErrorSinkConfig
+		code   ProcessingErrorCode
+		accept bool
+	}{
+		{"No filter", ErrorSinkConfig{}, BlankPDFDateError, true},
+		{"Severity override", ErrorSinkConfig{MinSeverity: "critical"}, SendMessageError, true},
+		{"Below minimum", ErrorSinkConfig{MinSeverity: "error"}, GetUrlContentError, false},
+		{"Listed code", ErrorSinkConfig{Codes: []string{"sendmessageerror"}}, SendMessageError, true},
+		{"Unlisted code", ErrorSinkConfig{Codes: []string{"SendMessageError"}}, ReadTemplateError, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.sink.accepts(&bc, &ProcessingError{Code: test.code}); got != test.accept {
+				t.Errorf("want: accepted %t; got: %t\n", test.accept, got)
+			}
+		})
+	}
+}
+
+func TestCheckErrorSink(t *testing.T) {
+	sinks := []ErrorSinkConfig{
+		{Type: "stderr", Format: "yaml", Codes: []string{"NoSuchError"}},
+		{Type: "file"},
+		{Type: "webhook", Url: "ftp://example.com", Headers: []string{"no colon"}},
+		{Type: "smtp", SMTP: &SMTPConfig{Address: "smtp.example.com", From: "bot@example.com"}},
+		{Type: "pager", MinSeverity: "loud"},
+		{Type: "webhook", Url: "https://example.com/hook", Headers: []string{"Authorization: Bearer x"}},
+	}
+
+	var problems configProblems
+	for i := range sinks {
+		checkErrorSink(&sinks[i], fmt.Sprintf("Errors.Sinks[%d]", i), &problems)
+	}
+
+	want := []string{
+		"Errors.Sinks[0].Codes[0]",
+		"Errors.Sinks[0].Format",
+		"Errors.Sinks[1].Path",
+		"Errors.Sinks[2].Url",
+		"Errors.Sinks[2].Headers[0]",
+		"Errors.Sinks[3].SMTP.Address",
+		"Errors.Sinks[3].SMTP.To",
+		"Errors.Sinks[4].MinSeverity",
+		"Errors.Sinks[4].Type",
+	}
+	if len(problems.Problems) != len(want) {
+		t.Fatalf("want: %d problems; got: %v\n", len(want), problems.Problems)
+	}
+	for i, field := range want {
+		if problems.Problems[i].Field != field {
+			t.Errorf("want: problem %d at '%s'; got: %+v\n", i, field, problems.Problems[i])
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var got map[string]any
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("could not decode payload: %s\n", err)
+		}
+	}))
+	defer server.Close()
+
+	sink := newErrorSink(&ErrorSinkConfig{Type: WEBHOOK_SINK, Url: server.URL, Headers: []string{"Authorization: Bearer secret"}})
+	if err := sink.Send(testAlert(SendMessageError)); err != nil {
+		t.Fatalf("could not send alert: %s\n", err)
+	}
+
+	if auth != "Bearer secret" {
+		t.Errorf("want: header sent; got: '%s'\n", auth)
+	}
+	if got["Kind"] != "error" || got["Bot"] != "bot_1" || got["Error"].(map[string]any)["Code"] != "SendMessageError" {
+		t.Errorf("want: alert payload; got: %v\n", got)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	if err := newErrorSink(&ErrorSinkConfig{Type: WEBHOOK_SINK, Url: failing.URL}).Send(testAlert(SendMessageError)); err == nil {
+		t.Errorf("want: error on 502 answer\n")
+	}
+}
+
+func TestDeliverAlertToSlowSink(t *testing.T) {
+	release := make(chan struct{})
+	var received atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		received.Add(1)
+	}))
+	defer server.Close()
+	bc := BotConfig{Name: "bot_1", Errors: &ErrorsConfig{Sinks: []ErrorSinkConfig{{Type: WEBHOOK_SINK, Url: server.URL}}}}
+
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		for range 3 {
+			alert := testAlert(SendMessageError)
+			deliverAlert(nil, &bc, alert, alert.LastSeen)
+		}
+	}()
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want: alerts queued without waiting for the webhook\n")
+	}
+
+	close(release)
+	flushSinks()
+	if n := received.Load(); n != 3 {
+		t.Errorf("want: 3 alerts sent once flushed; got: %d\n", n)
+	}
+}
+
+func TestDeliverAlertToFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.jsonl")
+	bc := BotConfig{
+		Name: "bot_1",
+		Errors: &ErrorsConfig{
+			MinSeverity: "critical", // only filters the admin chats
+			Sinks: []ErrorSinkConfig{
+				{Type: FILE_SINK, Path: path, Format: "json"},
+				{Type: FILE_SINK, Path: path, Codes: []string{"ReadTemplateError"}},
+			},
+		},
+	}
+
+	alert := testAlert(SendMessageError)
+	deliverAlert(nil, &bc, alert, alert.LastSeen)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read sink file: %s\n", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("want: one alert; got: %q\n", lines)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &decoded); err != nil {
+		t.Fatalf("could not decode alert: %s\n", err)
+	}
+	if decoded["Error"].(map[string]any)["Message"] != "<boom>" {
+		t.Errorf("want: raw message in JSON; got: %s\n", lines[0])
+	}
+}
+
+func TestSmtpMessage(t *testing.T) {
+	config := &SMTPConfig{From: "bot@example.com", To: []string{"a@example.com", "b@example.com"}}
+	alert := testAlert(GetUrlContentError)
+
+	msg := string(smtpMessage(config, alert, alert.LastSeen))
+	for _, want := range []string{
+		"To: a@example.com, b@example.com\r\n",
+		"Subject: [bot_1] error: GetUrlContentError in chat_1/Test1\r\n",
+		"\r\n\r\nError: GetUrlContentError\r\n",
+		"  - message:   <boom>\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("want: '%s' in message; got: '%s'\n", want, msg)
+		}
+	}
+}
+
+func TestSmtpMessageEncodesSubject(t *testing.T) {
+	config := &SMTPConfig{From: "bot@example.com", To: []string{"a@example.com"}}
+	alert := testAlert(GetUrlContentError)
+	alert.Error.Proc = "Oposición"
+
+	msg := string(smtpMessage(config, alert, alert.LastSeen))
+	want := "Subject: =?utf-8?q?[bot=5F1]_error:_GetUrlContentError_in_chat=5F1/Oposici=C3=B3n?=\r\n"
+	if !strings.Contains(msg, want) {
+		t.Errorf("want: '%s' in message; got: '%s'\n", want, msg)
+	}
+}
+
+func TestSmtpSinkEnvelope(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s\n", err)
+	}
+	defer ln.Close()
+
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var envelope []string
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 localhost ready\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO", "HELO":
+				fmt.Fprint(conn, "250 localhost\r\n")
+			case "MAIL", "RCPT":
+				envelope = append(envelope, line)
+				fmt.Fprint(conn, "250 ok\r\n")
+			case "DATA":
+				fmt.Fprint(conn, "354 go ahead\r\n")
+				for line != "." {
+					if line, err = r.ReadString('\n'); err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+				}
+				fmt.Fprint(conn, "250 ok\r\n")
+			case "QUIT":
+				fmt.Fprint(conn, "221 bye\r\n")
+				commands <- envelope
+				return
+			default:
+				fmt.Fprint(conn, "502 unknown\r\n")
+			}
+		}
+	}()
+
+	config := &SMTPConfig{
+		Address: ln.Addr().String(),
+		From:    "AEMET bot <bot@example.com>",
+		To:      []string{"Admin <a@example.com>", "b@example.com"},
+	}
+	if err := newErrorSink(&ErrorSinkConfig{Type: SMTP_SINK, SMTP: config}).Send(testAlert(SendMessageError)); err != nil {
+		t.Fatalf("could not send alert: %s\n", err)
+	}
+
+	want := []string{"MAIL FROM:<bot@example.com>", "RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>"}
+	select {
+	case got := <-commands:
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("want: %q; got: %q\n", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("want: mail sent\n")
+	}
+}
+
+func TestDeliverAlertToAdmins(t *testing.T) {
+	bot, tt := newTestBot(t)
+	bc := BotConfig{Name: "bot_1", ChatAdminConfig: &ChatAdminConfig{Name: "admin", ChatId: "-100"}}
+
+	alert := testAlert(SendMessageError)
+	deliverAlert(bot, &bc, alert, alert.LastSeen)
+	flushSinks()
+
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	if len(tt.calls) != 1 || tt.calls[0].Method != "sendMessage" || tt.calls[0].Params["chat_id"] != "-100" {
+		t.Errorf("want: alert sent to the admin chat; got: %v\n", tt.calls)
+	}
+}
+
+func TestPruneSinkQueues(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	queues := func() int {
+		sinkQueuesMu.Lock()
+		defer sinkQueuesMu.Unlock()
+		n := 0
+		for _, q := range sinkQueues {
+			if q.bot == "prune_bot" {
+				n++
+			}
+		}
+		return n
+	}
+
+	bc := BotConfig{Name: "prune_bot", Errors: &ErrorsConfig{Sinks: []ErrorSinkConfig{{Type: WEBHOOK_SINK, Url: server.URL + "/a"}}}}
+	alert := testAlert(SendMessageError)
+	deliverAlert(nil, &bc, alert, alert.LastSeen)
+
+	reloaded := bc.Clone()
+	reloaded.Errors.Sinks[0].Url = server.URL + "/b"
+	deliverAlert(nil, &reloaded, alert, alert.LastSeen)
+	if n := queues(); n != 2 {
+		t.Fatalf("want: 2 queues before pruning; got: %d\n", n)
+	}
+
+	pruneSinkQueues(nil, &reloaded)
+	if n := queues(); n != 1 {
+		t.Errorf("want: the queue of the edited sink stopped; got: %d queues\n", n)
+	}
+	flushSinks()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"html"
+	"strings"
+)
+
+// Kinds of processing errors, to be matched with errors.Is.
+var (
+	ErrFetch    = errors.New("fetch error")
+	ErrParse    = errors.New("parse error")
+	ErrTemplate = errors.New("template error")
+	ErrRegistry = errors.New("registry error")
+	ErrSend     = errors.New("send error")
+)
+
+// ProcessingErrorCode tells apart the errors of a kind. Codes are referenced
+// by name in the configuration and the metrics, so they must not be renamed.
+type ProcessingErrorCode int
+
+const (
+	SendMessageError ProcessingErrorCode = iota + 1
+	ReadTemplateError
+	ReadRegistryError
+	WriteRegistryError
+	UnmarshalRegistryError
+	MarshalRegistryError
+	GetUrlContentError
+	BlankPDFDateError
+)
+
+type errorCodeInfo struct {
+	name      string
+	kind      error
+	retryable bool // whether the next round may succeed without a fix
+}
+
+var errorCodes = map[ProcessingErrorCode]errorCodeInfo{
+	SendMessageError:       {"SendMessageError", ErrSend, true},
+	ReadTemplateError:      {"ReadTemplateError", ErrTemplate, false},
+	ReadRegistryError:      {"ReadRegistryError", ErrRegistry, false},
+	WriteRegistryError:     {"WriteRegistryError", ErrRegistry, true},
+	UnmarshalRegistryError: {"UnmarshalRegistryError", ErrRegistry, false},
+	MarshalRegistryError:   {"MarshalRegistryError", ErrRegistry, false},
+	GetUrlContentError:     {"GetUrlContentError", ErrFetch, true},
+	BlankPDFDateError:      {"BlankPDFDateError", ErrParse, false},
+}
+
+func (code ProcessingErrorCode) String() string {
+	return errorCodes[code].name
+}
+
+// Kind returns the sentinel error of the kind of the code.
+func (code ProcessingErrorCode) Kind() error {
+	return errorCodes[code].kind
+}
+
+func parseErrorCode(s string) (ProcessingErrorCode, bool) {
+	for code, info := range errorCodes {
+		if strings.EqualFold(info.name, s) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// ProcessingError is an error found while processing a selective process,
+// with where it happened. It matches the sentinel of its kind with errors.Is
+// and unwraps to the underlying error.
+type ProcessingError struct {
+	Code      ProcessingErrorCode
+	Chat      string
+	Proc      string
+	PDF       string
+	URL       string
+	Retryable bool
+	Err       error
+}
+
+// newProcessingError wraps err with the context of the selective process,
+// retryable as its code unless err says otherwise.
+func newProcessingError(code ProcessingErrorCode, c *ChatConfig, sp *SelectiveProc, err error) *ProcessingError {
+	pe := &ProcessingError{
+		Code:      code,
+		Chat:      c.Name,
+		Proc:      sp.Name,
+		URL:       sp.Url,
+		Retryable: errorCodes[code].retryable,
+		Err:       err,
+	}
+
+	// Telegram refuses the same message again for client errors, but a
+	// flood error only asks to wait
+	var teleErr *tele.Error
+	if code == SendMessageError && errors.As(err, &teleErr) && teleErr.Code >= 400 && teleErr.Code < 500 {
+		pe.Retryable = false
+	}
+	return pe
+}
+
+func (pe *ProcessingError) Error() string {
+	var where strings.Builder
+	where.WriteString(pe.Chat)
+	if pe.Proc != "" {
+		where.WriteString("/" + pe.Proc)
+	}
+	if pe.PDF != "" {
+		where.WriteString("/" + pe.PDF)
+	}
+	return fmt.Sprintf("%s at %s: %v", pe.Code, where.String(), pe.Err)
+}
+
+func (pe *ProcessingError) Unwrap() error {
+	return pe.Err
+}
+
+func (pe *ProcessingError) Is(target error) bool {
+	return target == pe.Code.Kind()
+}
+
+func (pe *ProcessingError) message() string {
+	if pe.Err == nil {
+		return ""
+	}
+	return pe.Err.Error()
+}
+
+// HTML renders the error for Telegram, escaping everything that comes from
+// the error, the configuration or the page.
+func (pe *ProcessingError) HTML() string {
+	format := "Error: <strong>%s</strong>\n" +
+		"  - chat name: <i>%s</i>\n" +
+		"  - proc name: <i>%s</i>\n" +
+		"  - pdf name:  <i>%s</i>\n" +
+		"  - retryable: %t\n" +
+		"  - message:   <pre language=\"console\">%s</pre>\n"
+
+	return fmt.Sprintf(format,
+		pe.Code,
+		html.EscapeString(pe.Chat),
+		html.EscapeString(pe.Proc),
+		html.EscapeString(pe.PDF),
+		pe.Retryable,
+		html.EscapeString(pe.message()),
+	)
+}
+
+// Text renders the error as plain text, e.g. for mail or the terminal.
+func (pe *ProcessingError) Text() string {
+	var text strings.Builder
+	fmt.Fprintf(&text, "Error: %s\n", pe.Code)
+	fmt.Fprintf(&text, "  - chat name: %s\n", pe.Chat)
+	fmt.Fprintf(&text, "  - proc name: %s\n", pe.Proc)
+	if pe.PDF != "" {
+		fmt.Fprintf(&text, "  - pdf name:  %s\n", pe.PDF)
+	}
+	if pe.URL != "" {
+		fmt.Fprintf(&text, "  - url:       %s\n", pe.URL)
+	}
+	fmt.Fprintf(&text, "  - retryable: %t\n", pe.Retryable)
+	fmt.Fprintf(&text, "  - message:   %s\n", pe.message())
+	return text.String()
+}
+
+func (pe *ProcessingError) MarshalJSON() ([]byte, error) {
+	kind := ""
+	if k := pe.Code.Kind(); k != nil {
+		kind = k.Error()
+	}
+	return json.Marshal(struct {
+		Code      string
+		Kind      string
+		Chat      string
+		Proc      string
+		PDF       string `json:",omitempty"`
+		URL       string `json:",omitempty"`
+		Retryable bool
+		Message   string
+	}{pe.Code.String(), kind, pe.Chat, pe.Proc, pe.PDF, pe.URL, pe.Retryable, pe.message()})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestProcessingErrorWrapping(t *testing.T) {
+	c := &ChatConfig{Name: "chat_1"}
+	sp := &SelectiveProc{Name: "Test1", Url: "https://example.com/test1"}
+
+	pe := newProcessingError(ReadRegistryError, c, sp, fmt.Errorf("could not read: %w", fs.ErrNotExist))
+	var err error = fmt.Errorf("round failed: %w", pe)
+
+	if !errors.Is(err, ErrRegistry) || errors.Is(err, ErrFetch) {
+		t.Errorf("want: only a registry error; got: %v\n", err)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want: underlying error unwrapped; got: %v\n", err)
+	}
+
+	var target *ProcessingError
+	if !errors.As(err, &target) || target.Chat != "chat_1" || target.Proc != "Test1" || target.URL != sp.Url {
+		t.Errorf("want: context of the proc; got: %+v\n", target)
+	}
+	if want := "ReadRegistryError at chat_1/Test1: could not read: file does not exist"; pe.Error() != want {
+		t.Errorf("want: '%s'; got: '%s'\n", want, pe.Error())
+	}
+}
+
+func TestProcessingErrorRetryable(t *testing.T) {
+	c, sp := &ChatConfig{Name: "chat_1"}, &SelectiveProc{Name: "Test1"}
+
+	tests := []struct {
+		name      string
+		code      ProcessingErrorCode
+		err       error
+		retryable bool
+	}{
+		{"Fetch", GetUrlContentError, errors.New("timeout"), true},
+		{"Template", ReadTemplateError, fs.ErrNotExist, false},
+		{"Send network", SendMessageError, errors.New("connection reset"), true},
+		{"Send rejected", SendMessageError, tele.ErrChatNotFound, false},
+		{"Send server", SendMessageError, tele.NewError(502, "Bad Gateway"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := newProcessingError(test.code, c, sp, test.err).Retryable; got != test.retryable {
+				t.Errorf("want: retryable %t; got: %t\n", test.retryable, got)
+			}
+		})
+	}
+}
+
+func TestProcessingErrorRendering(t *testing.T) {
+	pe := &ProcessingError{
+		Code: ReadTemplateError,
+		Chat: "chat_1",
+		Proc: "Test<1>",
+		PDF:  "a & b.pdf",
+		Err:  errors.New("unexpected <tag> in template"),
+	}
+
+	msg := pe.HTML()
+	for _, unsafe := range []string{"<tag>", "<1>", "a & b"} {
+		if strings.Contains(msg, unsafe) {
+			t.Errorf("want: '%s' escaped; got: '%s'\n", unsafe, msg)
+		}
+	}
+	if !strings.Contains(msg, "unexpected &lt;tag&gt; in template") {
+		t.Errorf("want: escaped message; got: '%s'\n", msg)
+	}
+
+	if text := pe.Text(); !strings.Contains(text, "  - message:   unexpected <tag> in template\n") {
+		t.Errorf("want: raw message in text; got: '%s'\n", text)
+	}
+
+	data, err := json.Marshal(pe)
+	if err != nil {
+		t.Fatalf("could not encode error: %s\n", err)
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("could not decode error: %s\n", err)
+	}
+	if decoded["Code"] != "ReadTemplateError" || decoded["Kind"] != "template error" || decoded["Message"] != "unexpected <tag> in template" {
+		t.Errorf("want: code, kind and message; got: %s\n", data)
+	}
+	if _, ok := decoded["URL"]; ok {
+		t.Errorf("want: empty url omitted; got: %s\n", data)
+	}
+}
@@ -3,8 +3,22 @@ module github.com/albertoCCz/aemet_tg_bot
 go 1.24.3
 
 require (
+	github.com/BurntSushi/toml v1.5.0
+	github.com/prometheus/client_golang v1.20.5
 	golang.org/x/net v0.40.0
 	gopkg.in/telebot.v3 v3.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/albertoCCz/logman v0.0.0-20240317114349-89a709869997
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/kylelemons/godebug v1.1.0 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
+	golang.org/x/sys v0.33.0 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+)
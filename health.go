@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default health thresholds, see HealthConfig.
+const (
+	DEFAULT_MAX_SCHEDULER_DELAY = time.Minute
+	DEFAULT_ROUND_AGE_INTERVALS = 3
+)
+
+// HealthConfig sets when /healthz and /readyz report a failure.
+type HealthConfig struct {
+	MaxSchedulerDelay Duration `json:",omitempty"` // since the last scheduler tick, default 1m
+	MaxRoundAge       Duration `json:",omitempty"` // since the last successful round of a proc, default 3 TimeIntervals
+}
+
+func (bc *BotConfig) maxSchedulerDelay() time.Duration {
+	if bc.Health != nil && bc.Health.MaxSchedulerDelay > 0 {
+		return bc.Health.MaxSchedulerDelay.Duration()
+	}
+	return DEFAULT_MAX_SCHEDULER_DELAY
+}
+
+func (bc *BotConfig) maxRoundAge() time.Duration {
+	if bc.Health != nil && bc.Health.MaxRoundAge > 0 {
+		return bc.Health.MaxRoundAge.Duration()
+	}
+	return DEFAULT_ROUND_AGE_INTERVALS * bc.TimeInterval.Duration()
+}
+
+type procKey struct {
+	Bot  string // chats of different bots may have the same name
+	Chat string
+	Proc string
+}
+
+// healthTracker keeps what the health checks need to know about the rounds.
+type healthTracker struct {
+	mu         sync.Mutex
+	started    time.Time
+	lastTick   time.Time
+	lastRounds map[procKey]time.Time // last round of a proc without errors
+}
+
+func newHealthTracker() *healthTracker {
+	now := time.Now()
+	return &healthTracker{started: now, lastTick: now, lastRounds: map[procKey]time.Time{}}
+}
+
+var health = newHealthTracker()
+
+func (h *healthTracker) Tick(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastTick = now
+}
+
+func (h *healthTracker) RoundSucceeded(botName, chatName, procName string, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRounds[procKey{botName, chatName, procName}] = now
+}
+
+type procHealth struct {
+	Chat          string
+	Proc          string
+	LastSuccess   *time.Time `json:",omitempty"`
+	RegistryError string     `json:",omitempty"`
+	Error         string     `json:",omitempty"`
+	Ok            bool
+}
+
+type botHealth struct {
+	Name          string
+	Paused        bool
+	TelegramError string `json:",omitempty"`
+	Procs         []procHealth
+	Ok            bool
+}
+
+type healthReport struct {
+	Ok       bool
+	LastTick time.Time
+	Error    string      `json:",omitempty"`
+	Bots     []botHealth `json:",omitempty"`
+}
+
+// liveness reports whether the scheduler is still running.
+func (h *healthTracker) liveness(instances []*botInstance, now time.Time) healthReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	report := healthReport{Ok: true, LastTick: h.lastTick}
+
+	maxDelay := DEFAULT_MAX_SCHEDULER_DELAY
+	if len(instances) > 0 {
+		maxDelay = instances[0].lc.Get().maxSchedulerDelay()
+	}
+	if delay := now.Sub(h.lastTick); delay > maxDelay {
+		report.Ok = false
+		report.Error = "scheduler stuck for " + delay.Round(time.Second).String()
+	}
+
+	return report
+}
+
+// checkProc reports whether the registry of a proc is readable and its last
+// successful round is recent enough. Paused bots do not run rounds, so their
+// rounds are not checked.
+func (h *healthTracker) checkProc(botName string, c *ChatConfig, sp *SelectiveProc, maxAge time.Duration, paused bool, now time.Time) procHealth {
+	ph := procHealth{Chat: c.Name, Proc: sp.Name, Ok: true}
+
+	if _, err := readRegistry(sp.RegistryPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ph.Ok = false
+		ph.RegistryError = err.Error()
+	}
+
+	h.mu.Lock()
+	last, ok := h.lastRounds[procKey{botName, c.Name, sp.Name}]
+	started := h.started
+	h.mu.Unlock()
+
+	if ok {
+		ph.LastSuccess = &last
+	} else {
+		last = started
+	}
+	if !paused && now.Sub(last) > maxAge {
+		ph.Ok = false
+		if ok {
+			ph.Error = "no successful round for " + now.Sub(last).Round(time.Second).String()
+		} else {
+			ph.Error = "no successful round yet"
+		}
+	}
+
+	return ph
+}
+
+// readiness reports whether every bot can reach Telegram and keeps its
+// selective processes up to date.
+func (h *healthTracker) readiness(instances []*botInstance, now time.Time) healthReport {
+	report := h.liveness(instances, now)
+
+	for _, b := range instances {
+		bc := b.lc.Get()
+		bh := botHealth{Name: bc.Name, Paused: b.paused.Load(), Ok: true}
+
+		if _, err := b.bot.Raw("getMe", nil); err != nil {
+			bh.Ok = false
+			bh.TelegramError = err.Error()
+		}
+
+		for _, c := range bc.ChatConfigs {
+			for _, sp := range c.SelectiveProcs {
+				ph := h.checkProc(bc.Name, &c, &sp, bc.maxRoundAge(), bh.Paused, now)
+				bh.Ok = bh.Ok && ph.Ok
+				bh.Procs = append(bh.Procs, ph)
+			}
+		}
+
+		report.Ok = report.Ok && bh.Ok
+		report.Bots = append(report.Bots, bh)
+	}
+
+	return report
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		slog.Error("Could not write health report", "error", err)
+	}
+}
+
+// serveStatus serves the metrics and the health checks on addr until the
+// process exits.
+func serveStatus(addr string, instances []*botInstance) {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, health.liveness(instances, time.Now()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, health.readiness(instances, time.Now()))
+	})
+
+	slog.Info("Serving metrics and health checks", "address", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("Could not serve metrics and health checks", "address", addr, "error", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLiveness(t *testing.T) {
+	h := newHealthTracker()
+	now := time.Now()
+	h.Tick(now)
+
+	if report := h.liveness(nil, now.Add(time.Second)); !report.Ok {
+		t.Errorf("want: ok; got: %+v\n", report)
+	}
+	if report := h.liveness(nil, now.Add(2*DEFAULT_MAX_SCHEDULER_DELAY)); report.Ok || report.Error == "" {
+		t.Errorf("want: scheduler stuck; got: %+v\n", report)
+	}
+}
+
+func TestCheckProc(t *testing.T) {
+	dir := t.TempDir()
+	badRegistry := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(badRegistry, []byte("{"), 0664); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+
+	c := ChatConfig{Name: "chat_1"}
+	sp := SelectiveProc{Name: "Test1", RegistryPath: filepath.Join(dir, "missing.json")}
+	maxAge := time.Minute
+
+	t.Run("Recent", func(t *testing.T) {
+		h := newHealthTracker()
+		h.RoundSucceeded("bot_name", "chat_1", "Test1", h.started.Add(time.Hour))
+		if ph := h.checkProc("bot_name", &c, &sp, maxAge, false, h.started.Add(time.Hour+time.Second)); !ph.Ok || ph.LastSuccess == nil {
+			t.Errorf("want: ok with last success; got: %+v\n", ph)
+		}
+	})
+
+	t.Run("Stale", func(t *testing.T) {
+		h := newHealthTracker()
+		h.RoundSucceeded("bot_name", "chat_1", "Test1", h.started)
+		if ph := h.checkProc("bot_name", &c, &sp, maxAge, false, h.started.Add(time.Hour)); ph.Ok {
+			t.Errorf("want: stale; got: %+v\n", ph)
+		}
+	})
+
+	t.Run("OtherBot", func(t *testing.T) {
+		h := newHealthTracker()
+		h.RoundSucceeded("other_bot", "chat_1", "Test1", h.started.Add(time.Hour))
+		if ph := h.checkProc("bot_name", &c, &sp, maxAge, false, h.started.Add(time.Hour)); ph.Ok || ph.LastSuccess != nil {
+			t.Errorf("want: rounds of a chat with the same name in another bot ignored; got: %+v\n", ph)
+		}
+	})
+
+	t.Run("NeverAfterStart", func(t *testing.T) {
+		h := newHealthTracker()
+		if ph := h.checkProc("bot_name", &c, &sp, maxAge, false, h.started.Add(time.Second)); !ph.Ok {
+			t.Errorf("want: ok while starting; got: %+v\n", ph)
+		}
+		if ph := h.checkProc("bot_name", &c, &sp, maxAge, false, h.started.Add(time.Hour)); ph.Ok || ph.Error != "no successful round yet" {
+			t.Errorf("want: no successful round yet; got: %+v\n", ph)
+		}
+	})
+
+	t.Run("Paused", func(t *testing.T) {
+		h := newHealthTracker()
+		if ph := h.checkProc("bot_name", &c, &sp, maxAge, true, h.started.Add(time.Hour)); !ph.Ok {
+			t.Errorf("want: ok while paused; got: %+v\n", ph)
+		}
+	})
+
+	t.Run("UnreadableRegistry", func(t *testing.T) {
+		h := newHealthTracker()
+		bad := SelectiveProc{Name: "Test1", RegistryPath: badRegistry}
+		if ph := h.checkProc("bot_name", &c, &bad, maxAge, true, h.started); ph.Ok || ph.RegistryError == "" {
+			t.Errorf("want: registry error; got: %+v\n", ph)
+		}
+	})
+}
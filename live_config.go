@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// liveConfig holds the bot configuration shared by the scheduler and the bot
+// commands. Readers get their own copy, so they never see a half applied
+// change; writers go through Update, which also persists the new config.
+type liveConfig struct {
+	mu      sync.RWMutex
+	path    string
+	bc      BotConfig
+	modTime time.Time // of the config file when last read or written
+}
+
+func newLiveConfig(path string, bc BotConfig) *liveConfig {
+	return &liveConfig{path: path, bc: bc, modTime: fileModTime(path)}
+}
+
+func (lc *liveConfig) Get() *BotConfig {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	bc := lc.bc.Clone()
+	return &bc
+}
+
+// Update applies f to a copy of the configuration and writes it to the config
+// file. The change only becomes visible if both steps succeed.
+func (lc *liveConfig) Update(f func(bc *BotConfig) error) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	bc := lc.bc.Clone()
+	if err := f(&bc); err != nil {
+		return err
+	}
+
+	if err := bc.WriteFile(lc.path); err != nil {
+		return err
+	}
+
+	lc.bc = bc
+	lc.modTime = fileModTime(lc.path)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLiveConfigUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botConfig.json")
+	lc := newLiveConfig(path, BotConfig{
+		Name:            "bot_name",
+		ChatAdminConfig: &ChatAdminConfig{ChatId: "admin_id", Name: "admin_name"},
+		ChatConfigs:     []ChatConfig{{ChatId: "chat_1_id", Name: "chat_1_name"}},
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		err := lc.Update(func(bc *BotConfig) error {
+			bc.ChatConfigs[0].SelectiveProcs = append(bc.ChatConfigs[0].SelectiveProcs, SelectiveProc{Name: "Test1"})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("could not update config: %s\n", err)
+		}
+
+		bc := lc.Get()
+		if len(bc.ChatConfigs[0].SelectiveProcs) != 1 {
+			t.Errorf("want: 1 selective process; got: %d\n", len(bc.ChatConfigs[0].SelectiveProcs))
+		}
+		if bc.ChatConfigs[0].ChatId != "chat_1_id" {
+			t.Errorf(errFmtString, "chat_1_id", bc.ChatConfigs[0].ChatId)
+		}
+
+		var written BotConfig
+		if err := written.ReadFile(path); err != nil {
+			t.Fatalf("could not read config: %s\n", err)
+		}
+		if len(written.ChatConfigs[0].SelectiveProcs) != 1 {
+			t.Errorf("want: 1 selective process written; got: %d\n", len(written.ChatConfigs[0].SelectiveProcs))
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		err := lc.Update(func(bc *BotConfig) error {
+			bc.ChatConfigs[0].SelectiveProcs = nil
+			return errors.New("some err")
+		})
+		if err == nil {
+			t.Errorf("want: error; got: nil\n")
+		}
+		if n := len(lc.Get().ChatConfigs[0].SelectiveProcs); n != 1 {
+			t.Errorf("want: config unchanged; got: %d selective processes\n", n)
+		}
+	})
+}
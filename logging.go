@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keys of the attributes shared by the log records.
+const (
+	LOG_CHAT_KEY       = "chat"
+	LOG_PROC_KEY       = "proc"
+	LOG_PDF_KEY        = "pdf"
+	LOG_URL_KEY        = "url"
+	LOG_ERROR_CODE_KEY = "error_code"
+	LOG_ROUND_ID_KEY   = "round_id"
+)
+
+const (
+	TEXT_LOG_FORMAT = "text"
+	JSON_LOG_FORMAT = "json"
+)
+
+// LogConfig sets how and where the bot logs. Logs always go to stderr and,
+// if Path is set, to that file too.
+type LogConfig struct {
+	Format     string   `json:",omitempty"` // text (default) or json
+	Level      string   `json:",omitempty"` // debug, info (default), warn or error
+	Path       string   `json:",omitempty"` // e.g. logs/aemet_tg_bot.log, the docker image's logs volume
+	MaxSize    int      `json:",omitempty"` // megabytes before the file is rotated, 0 for no limit
+	MaxAge     Duration `json:",omitempty"` // age before the file is rotated, 0 for no limit
+	MaxBackups int      `json:",omitempty"` // rotated files kept, 0 to keep them all
+}
+
+// checkLogConfig reports the problems of the log configuration at field.
+func checkLogConfig(lc *LogConfig, field string, problems *configProblems) {
+	var level slog.Level
+	if lc.Level != "" && level.UnmarshalText([]byte(lc.Level)) != nil {
+		problems.Add(field+".Level", "unknown level '%s', use debug, info, warn or error", lc.Level)
+	}
+
+	switch strings.ToLower(lc.Format) {
+	case "", TEXT_LOG_FORMAT, JSON_LOG_FORMAT:
+	default:
+		problems.Add(field+".Format", "unknown format '%s', use text or json", lc.Format)
+	}
+
+	if lc.MaxSize < 0 {
+		problems.Add(field+".MaxSize", "must not be negative, got %d", lc.MaxSize)
+	}
+	if lc.MaxAge < 0 {
+		problems.Add(field+".MaxAge", "must not be negative, got %s", lc.MaxAge)
+	}
+	if lc.MaxBackups < 0 {
+		problems.Add(field+".MaxBackups", "must not be negative, got %d", lc.MaxBackups)
+	}
+}
+
+// Level set with --log-level, overriding the configured one if not empty.
+var logLevelOverride string
+
+// newLogHandler builds the handler writing to w as configured by lc, which
+// may be nil.
+func newLogHandler(w io.Writer, lc *LogConfig) slog.Handler {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	configured := ""
+	if lc != nil {
+		configured = lc.Level
+	}
+	if logLevelOverride != "" {
+		configured = logLevelOverride
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(configured)); err == nil {
+		opts.Level = level
+	}
+
+	if lc != nil && strings.EqualFold(lc.Format, JSON_LOG_FORMAT) {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// setupLogging makes the configured logger the default one, also used by the
+// log package. The returned closer closes the log file, if any.
+func setupLogging(lc *LogConfig) (io.Closer, error) {
+	var w io.Writer = os.Stderr
+	var closer io.Closer = io.NopCloser(nil)
+
+	if lc != nil && lc.Path != "" {
+		rf, err := openRotatingFile(lc.Path, int64(lc.MaxSize)<<20, lc.MaxAge.Duration(), lc.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = io.MultiWriter(os.Stderr, rf)
+		closer = rf
+	}
+
+	slog.SetDefault(slog.New(newLogHandler(w, lc)))
+	return closer, nil
+}
+
+// rotatingFile is a log file that is renamed, with the rotation time as
+// suffix, once it grows past maxSize or gets older than maxAge. Only the
+// newest maxBackups rotated files are kept.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// files appended to keep their age, so restarts do not delay the rotation
+	rf.f, rf.size, rf.opened = f, info.Size(), info.ModTime()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	tooBig := rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize
+	tooOld := rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+	if tooBig || tooOld {
+		if err := rf.rotate(); err != nil {
+			return 0, fmt.Errorf("could not rotate log file '%s': %w", rf.path, err)
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+
+	rotated := rf.path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(rf.path, rotated); err != nil {
+		// keep logging to the current file, the rotation is retried later
+		return errors.Join(err, rf.open())
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+
+	if rf.maxBackups > 0 {
+		backups, err := filepath.Glob(rf.path + ".*")
+		if err != nil {
+			return err
+		}
+		sort.Strings(backups) // oldest first, the suffixes sort by time
+		for len(backups) > rf.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+
+	return nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewLogHandler(t *testing.T) {
+	t.Run("JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		h := newLogHandler(&buf, &LogConfig{Format: "json", Level: "warn"})
+		logger := slog.New(h)
+
+		logger.Info("not logged")
+		logger.Warn("logged", LOG_CHAT_KEY, "chat_1", LOG_ERROR_CODE_KEY, GetUrlContentError.String())
+
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("want: a single JSON record; got: '%s' (%s)\n", buf.String(), err)
+		}
+		if record["msg"] != "logged" || record[LOG_CHAT_KEY] != "chat_1" || record[LOG_ERROR_CODE_KEY] != "GetUrlContentError" {
+			t.Errorf("want: warning with chat and error code; got: %v\n", record)
+		}
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := slog.New(newLogHandler(&buf, nil))
+
+		logger.Debug("not logged")
+		logger.Info("logged", LOG_PROC_KEY, "Test1")
+		if got := buf.String(); strings.Contains(got, "not logged") || !strings.Contains(got, "level=INFO msg=logged proc=Test1") {
+			t.Errorf("want: text info record; got: '%s'\n", got)
+		}
+	})
+}
+
+func TestCheckLogConfig(t *testing.T) {
+	var problems configProblems
+	checkLogConfig(&LogConfig{Format: "xml", Level: "verbose", MaxSize: -1, MaxAge: Duration(-time.Hour), MaxBackups: -1}, "Log", &problems)
+
+	want := []string{"Log.Level", "Log.Format", "Log.MaxSize", "Log.MaxAge", "Log.MaxBackups"}
+	if len(problems.Problems) != len(want) {
+		t.Fatalf("want: %d problems; got: %d ('%s')\n", len(want), len(problems.Problems), problems.Error())
+	}
+	for i, p := range problems.Problems {
+		if p.Field != want[i] {
+			t.Errorf(errFmtString, want[i], p.Field)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "bot.log")
+
+	rf, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatalf("could not open log file: %s\n", err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"line 1\n", "line 2\n", "line 3\n", "line 4\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("could not write: %s\n", err)
+		}
+		time.Sleep(2 * time.Millisecond) // rotated files are named after the time
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "line 4\n" {
+		t.Errorf("want: 'line 4' in the current file; got: '%s' (%v)\n", data, err)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("want: 2 rotated files; got: %v\n", backups)
+	}
+	if data, _ := os.ReadFile(backups[1]); string(data) != "line 3\n" {
+		t.Errorf("want: 'line 3' in the newest rotated file; got: '%s'\n", data)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	rf, err := openRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("could not open log file: %s\n", err)
+	}
+	defer rf.Close()
+
+	if _, err := rf.Write([]byte("new\n")); err != nil {
+		t.Fatalf("could not write: %s\n", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("want: the old file rotated; got: '%s'\n", data)
+	}
+}
+
+func TestRotatingFileRenameError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.log")
+	rf, err := openRotatingFile(path, 10, 0, 0)
+	if err != nil {
+		t.Fatalf("could not open log file: %s\n", err)
+	}
+	defer rf.Close()
+
+	rf.Write([]byte("line 1\n"))
+	os.Remove(path) // the rename fails
+	if _, err := rf.Write([]byte("line 2\n")); err == nil {
+		t.Errorf("want: rotation error; got: nil\n")
+	}
+
+	if _, err := rf.Write([]byte("line 3\n")); err != nil {
+		t.Fatalf("want: the file reopened; got: %s\n", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "line 3\n" {
+		t.Errorf("want: 'line 3'; got: '%s'\n", data)
+	}
+}
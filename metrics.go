@@ -0,0 +1,95 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Path the metrics are served at, on BotConfig.MetricsAddress.
+const METRICS_PATH = "/metrics"
+
+var (
+	roundsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aemet_rounds_total",
+		Help: "Rounds run, by bot.",
+	}, []string{"bot"})
+	roundDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aemet_round_duration_seconds",
+		Help:    "Time taken by a round over every chat of a bot.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	}, []string{"bot"})
+	pageFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "aemet_page_fetch_duration_seconds",
+		Help:    "Time taken to fetch a selective process page.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"url"})
+	pageFetchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aemet_page_fetches_total",
+		Help: "Selective process page fetches, by url and HTTP status ('error' if there was no response).",
+	}, []string{"url", "status"})
+	pageLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aemet_page_last_success_timestamp_seconds",
+		Help: "Unix time of the last fetch of the page answered with 200 OK.",
+	}, []string{"url"})
+	pdfsFoundTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aemet_pdfs_found_total",
+		Help: "PDFs parsed from the selective process pages.",
+	}, []string{"bot", "chat", "proc"})
+	newPDFsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aemet_pdfs_new_total",
+		Help: "PDFs not found in the registry before.",
+	}, []string{"bot", "chat", "proc"})
+	telegramSendsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aemet_telegram_sends_total",
+		Help: "PDF messages sent to Telegram, by result (success or failure).",
+	}, []string{"bot", "chat", "result"})
+	processingErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aemet_processing_errors_total",
+		Help: "Processing errors, by code.",
+	}, []string{"code"})
+	registryEntries = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aemet_registry_entries",
+		Help: "PDFs in the registry of a selective process.",
+	}, []string{"bot", "chat", "proc"})
+	pausedGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "aemet_paused",
+		Help: "1 if the bot is paused, 0 otherwise.",
+	}, []string{"bot"})
+)
+
+func observeRound(botName string, summary roundSummary) {
+	roundsTotal.WithLabelValues(botName).Inc()
+	roundDuration.WithLabelValues(botName).Observe(summary.Duration.Seconds())
+}
+
+func observePageFetch(pageUrl string, start time.Time, res *http.Response, err error) {
+	pageFetchDuration.WithLabelValues(pageUrl).Observe(time.Since(start).Seconds())
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+		if res.StatusCode == http.StatusOK {
+			pageLastSuccess.WithLabelValues(pageUrl).SetToCurrentTime()
+		}
+	}
+	pageFetchesTotal.WithLabelValues(pageUrl, status).Inc()
+}
+
+func observeSend(botName, chatName string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	telegramSendsTotal.WithLabelValues(botName, chatName, result).Inc()
+}
+
+func observePaused(botName string, paused bool) {
+	value := 0.0
+	if paused {
+		value = 1
+	}
+	pausedGauge.WithLabelValues(botName).Set(value)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestObservePageFetch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	pc := newPageCache(0)
+	pc.Fetch(server.URL + "/ok")
+	pc.Fetch(server.URL + "/missing")
+
+	if got := testutil.ToFloat64(pageFetchesTotal.WithLabelValues(server.URL+"/ok", "200")); got != 1 {
+		t.Errorf("want: 1 fetch with status 200; got: %v\n", got)
+	}
+	if got := testutil.ToFloat64(pageFetchesTotal.WithLabelValues(server.URL+"/missing", "404")); got != 1 {
+		t.Errorf("want: 1 fetch with status 404; got: %v\n", got)
+	}
+	if got := testutil.ToFloat64(pageLastSuccess.WithLabelValues(server.URL + "/ok")); got == 0 {
+		t.Errorf("want: last success time set; got: 0\n")
+	}
+	if got := testutil.ToFloat64(pageLastSuccess.WithLabelValues(server.URL + "/missing")); got != 0 {
+		t.Errorf("want: no last success time; got: %v\n", got)
+	}
+}
+
+func TestObserveSend(t *testing.T) {
+	observeSend("metrics_bot", "metrics_chat", nil)
+	observeSend("metrics_bot", "metrics_chat", errors.New("chat not found"))
+	observeSend("metrics_bot", "metrics_chat", errors.New("chat not found"))
+
+	if got := testutil.ToFloat64(telegramSendsTotal.WithLabelValues("metrics_bot", "metrics_chat", "success")); got != 1 {
+		t.Errorf("want: 1 success; got: %v\n", got)
+	}
+	if got := testutil.ToFloat64(telegramSendsTotal.WithLabelValues("metrics_bot", "metrics_chat", "failure")); got != 2 {
+		t.Errorf("want: 2 failures; got: %v\n", got)
+	}
+
+	// chats with the same name in another bot are another series
+	observeSend("metrics_bot_2", "metrics_chat", nil)
+	if got := testutil.ToFloat64(telegramSendsTotal.WithLabelValues("metrics_bot_2", "metrics_chat", "success")); got != 1 {
+		t.Errorf("want: 1 success in the other bot; got: %v\n", got)
+	}
+	if got := testutil.ToFloat64(telegramSendsTotal.WithLabelValues("metrics_bot", "metrics_chat", "success")); got != 1 {
+		t.Errorf("want: 1 success; got: %v\n", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timeout of the requests made to fetch selective process pages.
+const PAGE_FETCH_TIMEOUT = 30 * time.Second
+
+type cachedPage struct {
+	ready     chan struct{} // closed when the fetch finishes
+	body      []byte
+	err       error
+	fetchedAt time.Time
+}
+
+// pageCache fetches selective process pages, sharing them between the chats
+// and bots that watch the same url. Concurrent fetches of a url wait for the
+// first one, and its result is reused for ttl. Failed fetches are not reused.
+type pageCache struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	client *http.Client
+	pages  map[string]*cachedPage
+}
+
+func newPageCache(ttl time.Duration) *pageCache {
+	return &pageCache{
+		ttl:    ttl,
+		client: &http.Client{Timeout: PAGE_FETCH_TIMEOUT},
+		pages:  map[string]*cachedPage{},
+	}
+}
+
+// The page cache shared by every bot in the process.
+var pages = newPageCache(0)
+
+func (pc *pageCache) Fetch(pageUrl string) ([]byte, error) {
+	pc.mu.Lock()
+	page, ok := pc.pages[pageUrl]
+	if ok {
+		select {
+		case <-page.ready:
+			if time.Since(page.fetchedAt) >= pc.ttl {
+				ok = false
+			}
+		default: // still fetching
+		}
+	}
+	if !ok {
+		page = &cachedPage{ready: make(chan struct{})}
+		pc.pages[pageUrl] = page
+		pc.mu.Unlock()
+
+		page.body, page.err = pc.get(pageUrl)
+		page.fetchedAt = time.Now()
+		close(page.ready)
+		if page.err != nil {
+			pc.mu.Lock()
+			if pc.pages[pageUrl] == page {
+				delete(pc.pages, pageUrl)
+			}
+			pc.mu.Unlock()
+		}
+		return page.body, page.err
+	}
+	pc.mu.Unlock()
+
+	<-page.ready
+	return page.body, page.err
+}
+
+func (pc *pageCache) get(pageUrl string) ([]byte, error) {
+	start := time.Now()
+	res, err := pc.client.Get(pageUrl)
+	observePageFetch(pageUrl, start, res, err)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// error pages would be parsed as pages without pdfs
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+
+	return io.ReadAll(res.Body)
+}
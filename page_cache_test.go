@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPageCache(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("page " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	t.Run("Concurrent", func(t *testing.T) {
+		requests.Store(0)
+		pc := newPageCache(0)
+
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if body, err := pc.Fetch(server.URL + "/a"); err != nil || string(body) != "page /a" {
+					t.Errorf("want: 'page /a'; got: '%s' (%v)\n", body, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if n := requests.Load(); n != 1 {
+			t.Errorf("want: 1 request; got: %d\n", n)
+		}
+	})
+
+	t.Run("Ttl", func(t *testing.T) {
+		requests.Store(0)
+		pc := newPageCache(time.Hour)
+
+		pc.Fetch(server.URL + "/a")
+		pc.Fetch(server.URL + "/a")
+		pc.Fetch(server.URL + "/b")
+		if n := requests.Load(); n != 2 {
+			t.Errorf("want: 2 requests; got: %d\n", n)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		requests.Store(0)
+		pc := newPageCache(0)
+
+		pc.Fetch(server.URL + "/a")
+		pc.Fetch(server.URL + "/a")
+		if n := requests.Load(); n != 2 {
+			t.Errorf("want: 2 requests; got: %d\n", n)
+		}
+	})
+
+	t.Run("ErrorStatus", func(t *testing.T) {
+		requests.Store(0)
+		pc := newPageCache(time.Hour)
+
+		for range 2 {
+			if body, err := pc.Fetch(server.URL + "/missing"); err == nil {
+				t.Errorf("want: error; got: '%s'\n", body)
+			}
+		}
+		if n := requests.Load(); n != 2 {
+			t.Errorf("want: 2 requests; got: %d\n", n)
+		}
+	})
+}
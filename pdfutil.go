@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"golang.org/x/net/html"
 	"io"
-	"log"
+	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
@@ -35,6 +35,7 @@ type PDF struct {
 	Url  string
 	Name string
 	Date string
+	Size int64 // bytes, from the size the page tells next to the name, 0 if unknown
 }
 
 func parsePDFDate(pdf *PDF) error {
@@ -56,7 +57,7 @@ func parsePDFDate(pdf *PDF) error {
 			comp = strings.TrimSpace(s_comp[0])
 			day_int, err = strconv.Atoi(comp)
 			if err != nil {
-				log.Printf("Could not parse day '%s' as int\n", s_comp[0])
+				slog.Debug("Could not parse day as int", "day", s_comp[0])
 				parsing_ok = false
 			}
 
@@ -64,7 +65,7 @@ func parsePDFDate(pdf *PDF) error {
 			comp = strings.TrimSpace(s_comp[1])
 			month_time, ok := MONTHS_ES[comp]
 			if !ok {
-				log.Printf("Could not parse month '%s' as int\n", comp)
+				slog.Debug("Could not parse month", "month", comp)
 				parsing_ok = false
 			}
 
@@ -75,13 +76,13 @@ func parsePDFDate(pdf *PDF) error {
 				comp = strings.TrimSpace(s_comp[2])
 				year_int, err = strconv.Atoi(comp)
 				if err != nil {
-					log.Printf("Could not parse year '%s' as int\n", comp)
+					slog.Debug("Could not parse year as int", "year", comp)
 					parsing_ok = false
 				}
 			}
 
 			if !parsing_ok {
-				log.Printf("Could not parse date from date string '%s'.\n Leaving PDF date blank\n", s)
+				slog.Warn("Could not parse date, leaving PDF date blank", LOG_PDF_KEY, pdf.Name, "date", s)
 				pdf.Date = ""
 				return fmt.Errorf("date could not be parsed from '%s'", s)
 			}
@@ -94,10 +95,18 @@ func parsePDFDate(pdf *PDF) error {
 	return fmt.Errorf("date could not be parsed. Regexp do not match with date string '%s'", pdf.Date)
 }
 
+var (
+	pdfSizeRegexp   = regexp.MustCompile(PDF_SIZE_REGEXP)
+	pdfSizeKBRegexp = regexp.MustCompile(`[0-9][0-9.,]*`) // with thousands separators, e.g. 1.234
+)
+
 func parsePDFName(pdf *PDF) {
-	var re = regexp.MustCompile(PDF_SIZE_REGEXP)
-	if s := re.FindString(pdf.Name); len(s) > 0 {
+	if s := pdfSizeRegexp.FindString(pdf.Name); len(s) > 0 {
 		pdf.Name = strings.ReplaceAll(pdf.Name, s, "")
+		digits := strings.NewReplacer(".", "", ",", "").Replace(pdfSizeKBRegexp.FindString(s))
+		if kb, err := strconv.ParseInt(digits, 10, 64); err == nil {
+			pdf.Size = kb << 10
+		}
 	}
 	pdf.Name = strings.TrimSpace(pdf.Name)
 }
@@ -129,9 +138,11 @@ func buildPDF(node *html.Node, a *html.Attribute) (PDF, error) {
 }
 
 func GenPDFs(r io.Reader, pdfs chan PDF) {
+	defer close(pdfs)
+
 	node, err := html.Parse(r)
 	if err != nil {
-		log.Println("Could not parse Node")
+		slog.Error("Could not parse page", "error", err)
 		return
 	}
 
@@ -155,5 +166,4 @@ func GenPDFs(r io.Reader, pdfs chan PDF) {
 		}
 	}
 	f(node)
-	close(pdfs)
 }
@@ -84,6 +84,15 @@ func TestParsePDFName(t *testing.T) {
 	if pdf.Name != want {
 		t.Errorf(errFmtString, want, pdf.Name)
 	}
+
+	pdf.Name = "my pdf name (1.234 KB)"
+	parsePDFName(&pdf)
+	if pdf.Name != want {
+		t.Errorf(errFmtString, want, pdf.Name)
+	}
+	if pdf.Size != 1234<<10 {
+		t.Errorf("want: %d; got: %d\n", 1234<<10, pdf.Size)
+	}
 }
 
 func TestGenPDFs(t *testing.T) {
@@ -148,3 +157,17 @@ func TestGenPDFs(t *testing.T) {
 	})
 
 }
+
+func TestParsePDFNameSize(t *testing.T) {
+	pdf := PDF{Name: "my pdf name (459 KB)"}
+	parsePDFName(&pdf)
+	if pdf.Size != 459*1024 {
+		t.Errorf("want: %d; got: %d\n", 459*1024, pdf.Size)
+	}
+
+	pdf = PDF{Name: "my pdf name"}
+	parsePDFName(&pdf)
+	if pdf.Size != 0 {
+		t.Errorf("want: unknown size; got: %d\n", pdf.Size)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_TEMPLATE_PATH = "./templates/template_fmt.txt"
+	DEFAULT_REGISTRY_DIR  = "./pdfs-registry"
+)
+
+func (bc *BotConfig) findChat(name string) *ChatConfig {
+	for i := range bc.ChatConfigs {
+		if strings.EqualFold(bc.ChatConfigs[i].Name, name) {
+			return &bc.ChatConfigs[i]
+		}
+	}
+	return nil
+}
+
+func (c *ChatConfig) findProc(name string) int {
+	for i := range c.SelectiveProcs {
+		if strings.EqualFold(c.SelectiveProcs[i].Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// fetchPDFs downloads the page at url and returns the pdfs found in it.
+func fetchPDFs(pageUrl string) ([]PDF, error) {
+	u, err := url.Parse(pageUrl)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("'%s' is not an http(s) url", pageUrl)
+	}
+
+	var client = &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(pageUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got status '%s' from '%s'", res.Status, pageUrl)
+	}
+
+	var pdfs []PDF
+	pdfs_ch := make(chan PDF)
+	go GenPDFs(res.Body, pdfs_ch)
+	for pdf := range pdfs_ch {
+		pdfs = append(pdfs, pdf)
+	}
+
+	return pdfs, nil
+}
+
+// fetchPDFDigest downloads the pdf at pdfUrl and returns its size and the hex
+// encoded sha256 of its content.
+func fetchPDFDigest(pdfUrl string) (int64, string, error) {
+	var client = &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Get(pdfBaseUrl(pdfUrl) + pdfUrl)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("got status '%s' from '%s'", res.Status, pdfUrl)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, res.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// newSelectiveProc builds a selective process for chat. The template is taken
+// from the chat's other processes and the registry is that of the other chats
+// watching the page or, if none, a new one next to the existing ones.
+func newSelectiveProc(bc *BotConfig, chat *ChatConfig, name, pageUrl string) SelectiveProc {
+	sp := SelectiveProc{
+		Name:         name,
+		TemplatePath: DEFAULT_TEMPLATE_PATH,
+		Url:          pageUrl,
+	}
+	if len(chat.SelectiveProcs) > 0 {
+		sp.TemplatePath = chat.SelectiveProcs[0].TemplatePath
+	}
+
+	for _, c := range bc.ChatConfigs {
+		for _, other := range c.SelectiveProcs {
+			if other.Url == pageUrl {
+				sp.RegistryPath = other.RegistryPath
+				return sp
+			}
+		}
+	}
+
+	registryDir := DEFAULT_REGISTRY_DIR
+	for _, c := range bc.ChatConfigs {
+		if len(c.SelectiveProcs) > 0 {
+			registryDir = filepath.Dir(c.SelectiveProcs[0].RegistryPath)
+			break
+		}
+	}
+	registryName := fmt.Sprintf("pdfs-%s-%s.json", registryFileName(chat.Name), registryFileName(name))
+	sp.RegistryPath = filepath.Join(registryDir, registryName)
+
+	return sp
+}
+
+// registryFileName returns name lowercased with every character but a-z, 0-9,
+// _ and - replaced by _, so it cannot point outside the registry directory.
+func registryFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(name))
+}
+
+// validProcName tells whether name can be given to a new selective process:
+// only letters, digits, _ and -.
+func validProcName(name string) bool {
+	return name != "" && registryFileName(name) == strings.ToLower(name)
+}
+
+func sendHTML(c tele.Context, command string, format string, a ...any) error {
+	err := c.Send(fmt.Sprintf(format, a...), &tele.SendOptions{ParseMode: "HTML", DisableWebPagePreview: true})
+	if err != nil {
+		slog.Error("Could not send response", "command", command, "error", err)
+	}
+	return err
+}
+
+func handleProcAdd(c tele.Context, bot *tele.Bot, lc *liveConfig, err_ch chan *ProcessingError) error {
+	args := queryArgs(c)
+	if len(args) < 3 || len(args) > 4 || (len(args) == 4 && args[3] != "init" && args[3] != "backfill") {
+		return sendHTML(c, "/proc_add", "Usage: <code>/proc_add &lt;chat&gt; &lt;name&gt; &lt;url&gt; [init|backfill]</code>")
+	}
+	chatName, procName, pageUrl := args[0], args[1], args[2]
+	initRegistry := len(args) == 4 && args[3] == "init"
+	if !validProcName(procName) {
+		return sendHTML(c, "/proc_add", "Invalid name '%s', use only letters, digits, _ and -", html.EscapeString(procName))
+	}
+
+	bc := lc.Get()
+	chat := bc.findChat(chatName)
+	if chat == nil {
+		return sendHTML(c, "/proc_add", "Unknown chat '%s'", html.EscapeString(chatName))
+	}
+	if chat.findProc(procName) >= 0 {
+		return sendHTML(c, "/proc_add", "Chat '%s' already has a selective process '%s'", html.EscapeString(chat.Name), html.EscapeString(procName))
+	}
+
+	pdfs, err := fetchPDFs(pageUrl)
+	if err != nil {
+		slog.Error("Could not validate url for new selective process", LOG_PROC_KEY, procName, LOG_URL_KEY, pageUrl, "error", err)
+		return sendHTML(c, "/proc_add", "Invalid url: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	sp := newSelectiveProc(bc, chat, procName, pageUrl)
+	sp.Backfill = len(args) == 4 && args[3] == "backfill"
+
+	// A new registry must be initialised before the process becomes visible to
+	// the scheduler, otherwise every pdf in the page would be sent. A shared
+	// one only sends the chat what is new from now on, unless backfilling.
+	if initRegistry {
+		initChat := *chat
+		initChat.SelectiveProcs = []SelectiveProc{sp}
+		summary := processChats(bot, []ChatConfig{initChat}, err_ch, roundOptions{bot: bc.Name})
+		if summary.Errors > 0 && summary.PagesFetched == 0 {
+			return sendHTML(c, "/proc_add", "Could not initialise registry '%s', selective process not added", html.EscapeString(sp.RegistryPath))
+		}
+	}
+
+	err = lc.Update(func(bc *BotConfig) error {
+		chat := bc.findChat(chatName)
+		if chat == nil {
+			return fmt.Errorf("unknown chat '%s'", chatName)
+		}
+		if chat.findProc(procName) >= 0 {
+			return fmt.Errorf("chat '%s' already has a selective process '%s'", chat.Name, procName)
+		}
+		chat.SelectiveProcs = append(chat.SelectiveProcs, sp)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Could not add selective process", LOG_CHAT_KEY, chatName, LOG_PROC_KEY, procName, "error", err)
+		return sendHTML(c, "/proc_add", "Could not add selective process: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	slog.Info("Selective process added", LOG_CHAT_KEY, chat.Name, LOG_PROC_KEY, procName, LOG_URL_KEY, pageUrl)
+	msg := "Selective process <b>%s</b> added to chat <b>%s</b>\n" +
+		"  - pdfs found: %d\n" +
+		"  - template:   <code>%s</code>\n" +
+		"  - registry:   <code>%s</code>"
+	if initRegistry {
+		msg += " (initialised)"
+	} else if sp.Backfill {
+		msg += " (backfilling)"
+	}
+	return sendHTML(c, "/proc_add", msg,
+		html.EscapeString(procName),
+		html.EscapeString(chat.Name),
+		len(pdfs),
+		html.EscapeString(sp.TemplatePath),
+		html.EscapeString(sp.RegistryPath),
+	)
+}
+
+func handleProcRm(c tele.Context, lc *liveConfig) error {
+	args := queryArgs(c)
+	if len(args) != 2 {
+		return sendHTML(c, "/proc_rm", "Usage: <code>/proc_rm &lt;chat&gt; &lt;name&gt;</code>")
+	}
+	chatName, procName := args[0], args[1]
+
+	var removed SelectiveProc
+	err := lc.Update(func(bc *BotConfig) error {
+		chat := bc.findChat(chatName)
+		if chat == nil {
+			return fmt.Errorf("unknown chat '%s'", chatName)
+		}
+		i := chat.findProc(procName)
+		if i < 0 {
+			return fmt.Errorf("chat '%s' has no selective process '%s'", chat.Name, procName)
+		}
+		removed = chat.SelectiveProcs[i]
+		chat.SelectiveProcs = append(chat.SelectiveProcs[:i], chat.SelectiveProcs[i+1:]...)
+		pruneMutes(bc, time.Now())
+		return nil
+	})
+	if err != nil {
+		slog.Error("Could not remove selective process", LOG_CHAT_KEY, chatName, LOG_PROC_KEY, procName, "error", err)
+		return sendHTML(c, "/proc_rm", "Could not remove selective process: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	slog.Info("Selective process removed", LOG_CHAT_KEY, chatName, LOG_PROC_KEY, removed.Name)
+	return sendHTML(c, "/proc_rm", "Selective process <b>%s</b> removed. Its registry <code>%s</code> was kept",
+		html.EscapeString(removed.Name),
+		html.EscapeString(removed.RegistryPath),
+	)
+}
+
+func handleProcSetTemplate(c tele.Context, lc *liveConfig) error {
+	args := queryArgs(c)
+	if len(args) != 3 {
+		return sendHTML(c, "/proc_set_template", "Usage: <code>/proc_set_template &lt;chat&gt; &lt;name&gt; &lt;template-path&gt;</code>")
+	}
+	chatName, procName, templatePath := args[0], args[1], args[2]
+
+	if _, err := os.ReadFile(templatePath); err != nil {
+		return sendHTML(c, "/proc_set_template", "Could not read template: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	err := lc.Update(func(bc *BotConfig) error {
+		chat := bc.findChat(chatName)
+		if chat == nil {
+			return fmt.Errorf("unknown chat '%s'", chatName)
+		}
+		i := chat.findProc(procName)
+		if i < 0 {
+			return fmt.Errorf("chat '%s' has no selective process '%s'", chat.Name, procName)
+		}
+		chat.SelectiveProcs[i].TemplatePath = templatePath
+		return nil
+	})
+	if err != nil {
+		slog.Error("Could not set template", LOG_CHAT_KEY, chatName, LOG_PROC_KEY, procName, "error", err)
+		return sendHTML(c, "/proc_set_template", "Could not set template: <pre>%s</pre>", html.EscapeString(err.Error()))
+	}
+
+	slog.Info("Template set", LOG_CHAT_KEY, chatName, LOG_PROC_KEY, procName, "path", templatePath)
+	return sendHTML(c, "/proc_set_template", "Template of <b>%s</b> set to <code>%s</code>", html.EscapeString(procName), html.EscapeString(templatePath))
+}
+
+func handleProcList(c tele.Context, lc *liveConfig) error {
+	bc := lc.Get()
+
+	chats := bc.ChatConfigs
+	if args := queryArgs(c); len(args) > 0 {
+		chat := bc.findChat(args[0])
+		if chat == nil {
+			return sendHTML(c, "/proc_list", "Unknown chat '%s'", html.EscapeString(args[0]))
+		}
+		chats = []ChatConfig{*chat}
+	}
+
+	var msg strings.Builder
+	for _, chat := range chats {
+		fmt.Fprintf(&msg, "<b>%s</b>\n", html.EscapeString(chat.Name))
+		if len(chat.SelectiveProcs) == 0 {
+			msg.WriteString("  <i>no selective processes</i>\n")
+		}
+		for _, sp := range chat.SelectiveProcs {
+			fmt.Fprintf(&msg, "  - <a href=\"%s\">%s</a>: <code>%s</code>, <code>%s</code>\n",
+				html.EscapeString(sp.Url),
+				html.EscapeString(sp.Name),
+				html.EscapeString(sp.TemplatePath),
+				html.EscapeString(sp.RegistryPath),
+			)
+		}
+	}
+	if msg.Len() == 0 {
+		msg.WriteString("No chats configured")
+	}
+
+	return sendHTML(c, "/proc_list", "%s", msg.String())
+}
+
+func registerProcHandlers(bot *tele.Bot, lc *liveConfig, err_ch chan *ProcessingError) {
+	bot.Handle("/proc_add", func(c tele.Context) error { return handleProcAdd(c, bot, lc, err_ch) })
+	bot.Handle("/proc_rm", func(c tele.Context) error { return handleProcRm(c, lc) })
+	bot.Handle("/proc_set_template", func(c tele.Context) error { return handleProcSetTemplate(c, lc) })
+	bot.Handle("/proc_list", func(c tele.Context) error { return handleProcList(c, lc) })
+}
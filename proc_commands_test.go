@@ -0,0 +1,52 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestNewSelectiveProcRegistryPath(t *testing.T) {
+	bc := BotConfig{ChatConfigs: []ChatConfig{
+		{Name: "chat_1", SelectiveProcs: []SelectiveProc{{Name: "Test1", Url: "url_1", RegistryPath: "pdfs-registry/pdfs-test1.json"}}},
+		{Name: "../Chat 2"},
+	}}
+
+	tests := []struct {
+		name string
+		chat int
+		proc string
+		url  string
+		want string
+	}{
+		{"Shared", 1, "Test1", "url_1", "pdfs-registry/pdfs-test1.json"},
+		{"New", 0, "Test2", "url_2", "pdfs-registry/pdfs-chat_1-test2.json"},
+		{"Sanitised", 1, "../../etc/x", "url_3", "pdfs-registry/pdfs-___chat_2-______etc_x.json"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sp := newSelectiveProc(&bc, &bc.ChatConfigs[test.chat], test.proc, test.url)
+			if sp.RegistryPath != test.want {
+				t.Errorf(errFmtString, test.want, sp.RegistryPath)
+			}
+			if filepath.Dir(sp.RegistryPath) != "pdfs-registry" {
+				t.Errorf("want: registry in 'pdfs-registry'; got: '%s'\n", sp.RegistryPath)
+			}
+		})
+	}
+}
+
+func TestValidProcName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Test1":      true,
+		"a1_libre-2": true,
+		"":           false,
+		"a/b":        false,
+		"..":         false,
+		"Técnicos":   false,
+	} {
+		if got := validProcName(name); got != want {
+			t.Errorf("%q: want: %v; got: %v\n", name, want, got)
+		}
+	}
+}
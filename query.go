@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"html"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	QUERY_PAGE_SIZE     = 5
+	QUERY_DEFAULT_N     = 5
+	QUERY_MAX_N         = 50
+	SEARCH_MAX_TEXT_LEN = 40 // callback data is limited to 64 bytes
+)
+
+// Item template used to list registry entries. It takes the same arguments as
+// the notification templates (see formatPDFMessage).
+const LIST_ITEM_TEMPLATE = "&#128196; <b>%s</b>: <a href=\"%s%s\">%s</a>"
+
+type queryResult struct {
+	sp    *SelectiveProc
+	entry registryEntry
+}
+
+// queryProcs returns the selective processes a chat can query. Regular chats
+// can query their own selective processes; viewers and above can query them all.
+func queryProcs(c tele.Context, bc *BotConfig) []SelectiveProc {
+	id := strconv.FormatInt(c.Chat().ID, 10)
+
+	if roleOf(c, bc) >= ViewerRole {
+		var procs []SelectiveProc
+		seen := map[string]bool{}
+		for _, c := range bc.ChatConfigs {
+			for _, sp := range c.SelectiveProcs {
+				if !seen[sp.RegistryPath] {
+					seen[sp.RegistryPath] = true
+					procs = append(procs, sp)
+				}
+			}
+		}
+		return procs
+	}
+
+	for _, c := range bc.ChatConfigs {
+		if c.ChatId == id {
+			return c.SelectiveProcs
+		}
+	}
+	return nil
+}
+
+func latestResults(procs []SelectiveProc, procName string, n int) ([]queryResult, error) {
+	for i := range procs {
+		if !strings.EqualFold(procs[i].Name, procName) {
+			continue
+		}
+
+		registry, err := readRegistry(procs[i].RegistryPath)
+		if err != nil {
+			return nil, err
+		}
+
+		var results []queryResult
+		for _, entry := range registry.Entries() {
+			if len(results) == n {
+				break
+			}
+			results = append(results, queryResult{sp: &procs[i], entry: entry})
+		}
+		return results, nil
+	}
+
+	return nil, fmt.Errorf("unknown selective process '%s'", procName)
+}
+
+func searchResults(procs []SelectiveProc, text string) []queryResult {
+	var results []queryResult
+	for i := range procs {
+		registry, err := readRegistry(procs[i].RegistryPath)
+		if err != nil {
+			slog.Warn("Could not read registry for search", LOG_PROC_KEY, procs[i].Name, "path", procs[i].RegistryPath, "error", err)
+			continue
+		}
+
+		for _, entry := range registry.Search(text) {
+			results = append(results, queryResult{sp: &procs[i], entry: entry})
+		}
+	}
+	return results
+}
+
+// formatResultsPage renders one page of results and the inline buttons to
+// move to the previous and next pages. Buttons carry the query in their data.
+func formatResultsPage(title string, results []queryResult, page int, unique string, data ...string) (string, *tele.ReplyMarkup) {
+	n_pages := (len(results) + QUERY_PAGE_SIZE - 1) / QUERY_PAGE_SIZE
+	page = max(0, min(page, n_pages-1))
+
+	msg := fmt.Sprintf("%s (%d/%d)\n\n", title, page+1, n_pages)
+	for _, r := range results[page*QUERY_PAGE_SIZE : min(len(results), (page+1)*QUERY_PAGE_SIZE)] {
+		template := LIST_ITEM_TEMPLATE
+		if r.entry.Date != "" {
+			template += " (" + html.EscapeString(r.entry.Date) + ")"
+		}
+		msg += formatPDFMessage(template, r.sp, r.entry.PDF) + "\n"
+	}
+
+	markup := &tele.ReplyMarkup{}
+	var buttons []tele.Btn
+	if page > 0 {
+		buttons = append(buttons, markup.Data("« Prev", unique, append([]string{strconv.Itoa(page - 1)}, data...)...))
+	}
+	if page < n_pages-1 {
+		buttons = append(buttons, markup.Data("Next »", unique, append([]string{strconv.Itoa(page + 1)}, data...)...))
+	}
+	if len(buttons) > 0 {
+		markup.Inline(markup.Row(buttons...))
+	}
+
+	return msg, markup
+}
+
+// sendResultsPage sends a new message with the page of results, or edits the
+// current one when the query comes from a pagination button.
+func sendResultsPage(c tele.Context, msg string, markup *tele.ReplyMarkup) error {
+	opts := &tele.SendOptions{ParseMode: "HTML", ReplyMarkup: markup, DisableWebPagePreview: true}
+	if c.Callback() != nil {
+		defer c.Respond()
+		return c.Edit(msg, opts)
+	}
+	return c.Send(msg, opts)
+}
+
+func queryArgs(c tele.Context) []string {
+	var args []string
+	for _, arg := range c.Args() {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+func handleLatest(c tele.Context, lc *liveConfig) error {
+	if c.Chat() == nil {
+		return nil
+	}
+
+	// Args are '<proc> [n]' when sent by users and 'page|proc|n' when sent by
+	// the pagination buttons, with proc as the index in queryProcs: names may
+	// not fit in the 64 bytes of callback data.
+	page := 0
+	args := queryArgs(c)
+	button := c.Callback() != nil && len(args) == 3
+	if button {
+		page, _ = strconv.Atoi(args[0])
+		args = args[1:]
+	}
+
+	if len(args) == 0 || len(args) > 2 {
+		return c.Send("Usage: <code>/latest &lt;proc&gt; [n]</code>", &tele.SendOptions{ParseMode: "HTML"})
+	}
+
+	n := QUERY_DEFAULT_N
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n <= 0 {
+			return c.Send(fmt.Sprintf("Invalid number of documents '%s'", html.EscapeString(args[1])), &tele.SendOptions{ParseMode: "HTML"})
+		}
+		n = min(n, QUERY_MAX_N)
+	}
+
+	procs := queryProcs(c, lc.Get())
+	if len(procs) == 0 {
+		return c.Send("This chat is not subscribed to any selective process")
+	}
+
+	procName := args[0]
+	if button {
+		i, err := strconv.Atoi(procName)
+		if err != nil || i < 0 || i >= len(procs) {
+			return c.Send("Selective process not found, run /latest again")
+		}
+		procName = procs[i].Name
+	}
+
+	results, err := latestResults(procs, procName, n)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c.Send("No documents registered yet")
+		}
+		slog.Error("Could not get latest documents", LOG_PROC_KEY, procName, "error", err)
+		return c.Send(fmt.Sprintf("Could not get latest documents: %s", html.EscapeString(err.Error())), &tele.SendOptions{ParseMode: "HTML"})
+	}
+	if len(results) == 0 {
+		return c.Send("No documents registered yet")
+	}
+
+	title := fmt.Sprintf("Latest documents for <b>%s</b>", html.EscapeString(results[0].sp.Name))
+	i := slices.IndexFunc(procs, func(sp SelectiveProc) bool { return strings.EqualFold(sp.Name, procName) })
+	msg, markup := formatResultsPage(title, results, page, "latest", strconv.Itoa(i), strconv.Itoa(n))
+	err = sendResultsPage(c, msg, markup)
+	if err != nil {
+		slog.Error("Could not send response", "command", "/latest", "error", err)
+	}
+	return err
+}
+
+func handleSearch(c tele.Context, lc *liveConfig) error {
+	if c.Chat() == nil {
+		return nil
+	}
+
+	// The search text is the command payload when sent by users and
+	// 'page|text' when sent by the pagination buttons.
+	page := 0
+	var text string
+	if cb := c.Callback(); cb != nil {
+		page_str, rest, _ := strings.Cut(cb.Data, "|")
+		page, _ = strconv.Atoi(page_str)
+		text = rest
+	} else {
+		text = strings.TrimSpace(c.Message().Payload)
+	}
+
+	if text == "" {
+		return c.Send("Usage: <code>/search &lt;text&gt;</code>", &tele.SendOptions{ParseMode: "HTML"})
+	}
+	if len(text) > SEARCH_MAX_TEXT_LEN {
+		return c.Send(fmt.Sprintf("Search text too long, use at most %d characters", SEARCH_MAX_TEXT_LEN))
+	}
+
+	procs := queryProcs(c, lc.Get())
+	if len(procs) == 0 {
+		return c.Send("This chat is not subscribed to any selective process")
+	}
+
+	results := searchResults(procs, text)
+	if len(results) == 0 {
+		return c.Send(fmt.Sprintf("No documents found for '%s'", html.EscapeString(text)), &tele.SendOptions{ParseMode: "HTML"})
+	}
+
+	title := fmt.Sprintf("Documents matching <i>%s</i>", html.EscapeString(text))
+	msg, markup := formatResultsPage(title, results, page, "search", text)
+	err := sendResultsPage(c, msg, markup)
+	if err != nil {
+		slog.Error("Could not send response", "command", "/search", "error", err)
+	}
+	return err
+}
+
+func registerQueryHandlers(bot *tele.Bot, lc *liveConfig) {
+	latest := func(c tele.Context) error { return handleLatest(c, lc) }
+	search := func(c tele.Context) error { return handleSearch(c, lc) }
+
+	bot.Handle("/latest", latest)
+	bot.Handle(&tele.Btn{Unique: "latest"}, latest)
+	bot.Handle("/search", search)
+	bot.Handle(&tele.Btn{Unique: "search"}, search)
+}
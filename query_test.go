@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// telegramCall is a request the bot made to the Telegram API.
+type telegramCall struct {
+	Method string
+	Params map[string]any
+}
+
+// testTelegram is a fake Telegram API recording the calls of the bot.
+type testTelegram struct {
+	mu    sync.Mutex
+	calls []telegramCall
+}
+
+func (tt *testTelegram) Calls() []telegramCall {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	return append([]telegramCall(nil), tt.calls...)
+}
+
+// newTestBot returns an offline bot talking to a fake Telegram API.
+func newTestBot(t *testing.T) (*tele.Bot, *testTelegram) {
+	tt := &testTelegram{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := telegramCall{Method: r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]}
+		json.NewDecoder(r.Body).Decode(&call.Params)
+		tt.mu.Lock()
+		tt.calls = append(tt.calls, call)
+		n := len(tt.calls)
+		tt.mu.Unlock()
+
+		if call.Method == "answerCallbackQuery" {
+			fmt.Fprint(w, `{"ok": true, "result": true}`)
+			return
+		}
+		fmt.Fprintf(w, `{"ok": true, "result": {"message_id": %d, "chat": {"id": -300}}}`, n)
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tele.NewBot(tele.Settings{URL: server.URL, Token: "token", Offline: true})
+	if err != nil {
+		t.Fatalf("could not create bot: %s\n", err)
+	}
+	return bot, tt
+}
+
+func newQueryTestConfig(t *testing.T, n int) *liveConfig {
+	path := filepath.Join(t.TempDir(), "pdfs-test1.json")
+	registry := newRegistry("Test1", "https://example.com/test1")
+	seen := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	for i := range n {
+		registry.PDFs[fmt.Sprintf("Listado %d", i)] = &PDFRecord{Url: fmt.Sprintf("/listado_%d.pdf", i), FirstSeen: seen.Add(time.Duration(i) * time.Hour)}
+	}
+	if err := writeRegistry(path, registry); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+
+	return newLiveConfig("", BotConfig{ChatConfigs: []ChatConfig{{
+		Name:   "chat_1",
+		ChatId: "-300",
+		SelectiveProcs: []SelectiveProc{
+			{Name: "Test1", RegistryPath: path},
+			{Name: "Test2", RegistryPath: filepath.Join(t.TempDir(), "missing.json")},
+		},
+	}}})
+}
+
+// queryMessage returns the text of the only message sent or edited and its
+// inline buttons.
+func queryMessage(t *testing.T, tt *testTelegram) (string, string) {
+	t.Helper()
+	var sent []telegramCall
+	for _, call := range tt.Calls() {
+		if call.Method == "sendMessage" || call.Method == "editMessageText" {
+			sent = append(sent, call)
+		}
+	}
+	if len(sent) != 1 {
+		t.Fatalf("want: 1 message; got: %+v\n", sent)
+	}
+	text, _ := sent[0].Params["text"].(string)
+	markup, _ := sent[0].Params["reply_markup"].(string)
+	return text, markup
+}
+
+func TestHandleLatest(t *testing.T) {
+	tests := []struct {
+		name     string
+		chatId   int64
+		args     string // of the command, or data of the button if callback
+		callback bool
+		want     string
+		buttons  []string
+	}{
+		{"Usage", -300, "", false, "Usage: <code>/latest", nil},
+		{"TooManyArgs", -300, "Test1 5 6", false, "Usage: <code>/latest", nil},
+		{"InvalidN", -300, "Test1 zero", false, "Invalid number of documents 'zero'", nil},
+		{"NegativeN", -300, "Test1 -1", false, "Invalid number of documents '-1'", nil},
+		{"NotSubscribed", -400, "Test1", false, "This chat is not subscribed", nil},
+		{"UnknownProc", -300, "Test9", false, "unknown selective process &#39;Test9&#39;", nil},
+		{"NoRegistry", -300, "Test2", false, "No documents registered yet", nil},
+		{"FirstPage", -300, "test1 7", false, "(1/2)", []string{"Next »"}},
+		{"FitsOnePage", -300, "Test1 3", false, "(1/1)", nil},
+		{"LastPage", -300, "1|0|7", true, "(2/2)", []string{"« Prev"}},
+		{"PastLastPage", -300, "9|0|7", true, "(2/2)", []string{"« Prev"}},
+		{"BeforeFirstPage", -300, "-1|0|7", true, "(1/2)", []string{"Next »"}},
+		{"CappedN", -300, "Test1 500", false, "(1/2)", []string{"Next »"}},
+		{"UnknownProcIndex", -300, "1|9|7", true, "Selective process not found", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot, tt := newTestBot(t)
+			update := tele.Update{Message: &tele.Message{Chat: &tele.Chat{ID: test.chatId}, Payload: test.args}}
+			if test.callback {
+				update = tele.Update{Callback: &tele.Callback{ID: "1", Data: test.args, Message: &tele.Message{ID: 1, Chat: &tele.Chat{ID: test.chatId}}}}
+			}
+
+			if err := handleLatest(bot.NewContext(update), newQueryTestConfig(t, 9)); err != nil {
+				t.Fatalf("could not handle command: %s\n", err)
+			}
+
+			text, markup := queryMessage(t, tt)
+			if !strings.Contains(text, test.want) {
+				t.Errorf("want: '%s' in the message; got: '%s'\n", test.want, text)
+			}
+			for _, button := range []string{"« Prev", "Next »"} {
+				want := strings.Contains(strings.Join(test.buttons, " "), button)
+				if got := strings.Contains(markup, button); got != want {
+					t.Errorf("want: button '%s' %v; got: %v ('%s')\n", button, want, got, markup)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleLatestPage(t *testing.T) {
+	bot, tt := newTestBot(t)
+	update := tele.Update{Callback: &tele.Callback{ID: "1", Data: "1|0|7", Message: &tele.Message{ID: 1, Chat: &tele.Chat{ID: -300}}}}
+	if err := handleLatest(bot.NewContext(update), newQueryTestConfig(t, 9)); err != nil {
+		t.Fatalf("could not handle command: %s\n", err)
+	}
+
+	// newest first: 8..4 in the first page, 3 and 2 in the second one
+	text, _ := queryMessage(t, tt)
+	for i := range 9 {
+		want := i == 2 || i == 3
+		if got := strings.Contains(text, fmt.Sprintf("Listado %d<", i)); got != want {
+			t.Errorf("want: 'Listado %d' in page %v; got: %v ('%s')\n", i, want, got, text)
+		}
+	}
+
+	var answered bool
+	for _, call := range tt.Calls() {
+		answered = answered || call.Method == "answerCallbackQuery"
+	}
+	if !answered {
+		t.Errorf("want: callback answered\n")
+	}
+}
+
+func TestHandleLatestLongProcName(t *testing.T) {
+	bc := newQueryTestConfig(t, 9).Get()
+	name := strings.Repeat("Oposicion_", 8)
+	bc.ChatConfigs[0].SelectiveProcs[0].Name = name
+	lc := newLiveConfig("", *bc)
+
+	bot, tt := newTestBot(t)
+	update := tele.Update{Message: &tele.Message{Chat: &tele.Chat{ID: -300}, Payload: name + " 7"}}
+	if err := handleLatest(bot.NewContext(update), lc); err != nil {
+		t.Fatalf("could not handle command: %s\n", err)
+	}
+
+	_, markup := queryMessage(t, tt)
+	var buttons struct {
+		InlineKeyboard [][]struct {
+			CallbackData string `json:"callback_data"`
+		} `json:"inline_keyboard"`
+	}
+	if err := json.Unmarshal([]byte(markup), &buttons); err != nil || len(buttons.InlineKeyboard) != 1 {
+		t.Fatalf("want: pagination buttons; got: '%s' (%v)\n", markup, err)
+	}
+	if data := buttons.InlineKeyboard[0][0].CallbackData; len(data) > 64 {
+		t.Errorf("want: callback data within 64 bytes; got: %d ('%s')\n", len(data), data)
+	}
+}
+
+func TestHandleSearch(t *testing.T) {
+	tests := []struct {
+		name     string
+		chatId   int64
+		text     string
+		callback bool
+		want     string
+		buttons  []string
+	}{
+		{"Usage", -300, "  ", false, "Usage: <code>/search", nil},
+		{"TooLong", -300, strings.Repeat("a", SEARCH_MAX_TEXT_LEN+1), false, "Search text too long", nil},
+		{"NotSubscribed", -400, "listado", false, "This chat is not subscribed", nil},
+		{"NoResults", -300, "bases", false, "No documents found for 'bases'", nil},
+		{"FirstPage", -300, " listado ", false, "(1/2)", []string{"Next »"}},
+		{"OnePage", -300, "listado 1", false, "(1/1)", nil},
+		{"LastPage", -300, "1|listado", true, "(2/2)", []string{"« Prev"}},
+		{"PastLastPage", -300, "3|listado", true, "(2/2)", []string{"« Prev"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bot, tt := newTestBot(t)
+			update := tele.Update{Message: &tele.Message{Chat: &tele.Chat{ID: test.chatId}, Payload: test.text}}
+			if test.callback {
+				update = tele.Update{Callback: &tele.Callback{ID: "1", Data: test.text, Message: &tele.Message{ID: 1, Chat: &tele.Chat{ID: test.chatId}}}}
+			}
+
+			if err := handleSearch(bot.NewContext(update), newQueryTestConfig(t, 9)); err != nil {
+				t.Fatalf("could not handle command: %s\n", err)
+			}
+
+			text, markup := queryMessage(t, tt)
+			if !strings.Contains(text, test.want) {
+				t.Errorf("want: '%s' in the message; got: '%s'\n", test.want, text)
+			}
+			for _, button := range []string{"« Prev", "Next »"} {
+				want := strings.Contains(strings.Join(test.buttons, " "), button)
+				if got := strings.Contains(markup, button); got != want {
+					t.Errorf("want: button '%s' %v; got: %v ('%s')\n", button, want, got, markup)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Version of the registry format written by the bot. Version 0 registries,
+// plain maps of pdf names to string fields, are upgraded when read.
+const REGISTRY_VERSION = 1
+
+// Keys of the fields of version 0 registry entries.
+const (
+	REGISTRY_URL_KEY        = "pdf_url"
+	REGISTRY_DATE_KEY       = "pdf_date"
+	REGISTRY_FIRST_SEEN_KEY = "first_seen"
+)
+
+// The LastSeen time of a pdf is only written to its registry when it is this
+// much older, so registries are not rewritten every round.
+const REGISTRY_LAST_SEEN_PRECISION = 24 * time.Hour
+
+// Old registries stored the publication date with this layout.
+const REGISTRY_OLD_DATE_LAYOUT = "2006/01/02"
+
+// Delivery statuses of a pdf in a chat.
+const (
+	DELIVERY_SENT    = "sent"
+	DELIVERY_FAILED  = "failed"
+	DELIVERY_SKIPPED = "skipped" // registered without sending, e.g. by init
+)
+
+// Delivery is what happened when a pdf was sent to a chat.
+type Delivery struct {
+	Status    string
+	At        time.Time
+	MessageId int    `json:",omitempty"` // of the Telegram message, if sent
+	Error     string `json:",omitempty"` // if failed
+}
+
+// PDFRecord is what the registry knows about a pdf of the page.
+type PDFRecord struct {
+	Url        string
+	Date       string               `json:",omitempty"` // as parsed from the page
+	FirstSeen  time.Time            `json:",omitzero"`  // unknown for entries of old registries
+	LastSeen   time.Time            `json:",omitzero"`
+	RemovedAt  time.Time            `json:",omitzero"`  // when it was last missing from the page
+	Size       int64                `json:",omitempty"` // bytes, as told by the page or downloaded
+	Hash       string               `json:",omitempty"` // sha256 of the content, hex encoded
+	Deliveries map[string]*Delivery `json:",omitempty"` // by chat name
+}
+
+func (rec *PDFRecord) clone() *PDFRecord {
+	clone := *rec
+	clone.Deliveries = nil
+	for chat, d := range rec.Deliveries {
+		delivery := *d
+		clone.setDelivery(chat, &delivery)
+	}
+	return &clone
+}
+
+func (rec *PDFRecord) setDelivery(chat string, d *Delivery) {
+	if rec.Deliveries == nil {
+		rec.Deliveries = map[string]*Delivery{}
+	}
+	rec.Deliveries[chat] = d
+}
+
+// pdfRegistry keeps the pdfs found in a page, by name, and what was sent of
+// them to every chat. Chats watching the same page share its registry.
+type pdfRegistry struct {
+	Version int
+	Proc    string               `json:",omitempty"` // of the first chat using it
+	Url     string               `json:",omitempty"` // of the page
+	Chats   map[string]time.Time `json:",omitempty"` // when each chat started using it
+	PDFs    map[string]*PDFRecord
+}
+
+func newRegistry(procName, pageUrl string) *pdfRegistry {
+	return &pdfRegistry{Version: REGISTRY_VERSION, Proc: procName, Url: pageUrl, PDFs: map[string]*PDFRecord{}}
+}
+
+func (r *pdfRegistry) clone() *pdfRegistry {
+	clone := *r
+	clone.Chats = maps.Clone(r.Chats)
+	clone.PDFs = make(map[string]*PDFRecord, len(r.PDFs))
+	for name, rec := range r.PDFs {
+		clone.PDFs[name] = rec.clone()
+	}
+	return &clone
+}
+
+// joinChat returns when the chat started using the registry, now if it is new
+// to it. Pdfs registered before that were not sent to the chat.
+func (r *pdfRegistry) joinChat(chat string, now time.Time) time.Time {
+	if joined, ok := r.Chats[chat]; ok {
+		return joined
+	}
+	if r.Chats == nil {
+		r.Chats = map[string]time.Time{}
+	}
+	r.Chats[chat] = now
+	return now
+}
+
+var registryLocks sync.Map // of *sync.Mutex, by clean path
+
+// lockRegistry blocks until no other chat is using the registry at path and
+// returns the function releasing it. Other processes, like the registry and
+// replay commands while the bot runs, are kept out with a flock on
+// <path>.lock.
+func lockRegistry(path string) func() {
+	mu, _ := registryLocks.LoadOrStore(filepath.Clean(path), &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0664)
+	if err == nil {
+		if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		// e.g. the registry directory does not exist yet
+		slog.Warn("Could not lock registry file", "path", path, "error", err)
+		return mu.(*sync.Mutex).Unlock
+	}
+
+	return func() {
+		f.Close() // releases the flock
+		mu.(*sync.Mutex).Unlock()
+	}
+}
+
+// updateRegistry reads the registry at path holding its lock and, if update
+// tells it changed it, writes it back.
+func updateRegistry(path string, update func(r *pdfRegistry) bool) error {
+	defer lockRegistry(path)()
+
+	registry, err := readRegistry(path)
+	if err != nil {
+		return err
+	}
+	if !update(registry) {
+		return nil
+	}
+	return writeRegistry(path, registry)
+}
+
+// legacyRegistry is the version 0 format.
+type legacyRegistry map[string]map[string]string
+
+// upgrade returns the registry in the current format, with its keys
+// normalized so old entries are not sent again, and a description of every
+// change. The dates are left for migrate.
+func (l legacyRegistry) upgrade() (*pdfRegistry, []string) {
+	r := newRegistry("", "")
+	for name, fields := range l {
+		pdf := PDF{Name: name}
+		parsePDFName(&pdf) // old keys tell the size
+		rec := &PDFRecord{Url: fields[REGISTRY_URL_KEY], Date: fields[REGISTRY_DATE_KEY], Size: pdf.Size}
+		if seen, err := time.Parse(time.RFC3339, fields[REGISTRY_FIRST_SEEN_KEY]); err == nil {
+			rec.FirstSeen = seen
+		}
+		r.PDFs[name] = rec
+	}
+
+	normalized, changes := r.Normalize()
+	return normalized, append([]string{fmt.Sprintf("format version 0 -> %d", REGISTRY_VERSION)}, changes...)
+}
+
+// decodeRegistry reads a registry of any version and returns it in the
+// current one, with the changes made to upgrade it.
+func decodeRegistry(data []byte) (*pdfRegistry, []string, error) {
+	var header struct{ Version *int }
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, nil, err
+	}
+
+	if header.Version == nil {
+		var legacy legacyRegistry
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, nil, err
+		}
+		r, changes := legacy.upgrade()
+		return r, changes, nil
+	}
+
+	if *header.Version > REGISTRY_VERSION {
+		return nil, nil, fmt.Errorf("registry format version %d is newer than %d, upgrade the bot", *header.Version, REGISTRY_VERSION)
+	}
+	r := newRegistry("", "")
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, nil, err
+	}
+	if r.PDFs == nil {
+		r.PDFs = map[string]*PDFRecord{}
+	}
+	return r, nil, nil
+}
+
+// readRegistryChanges reads the registry at path and tells the changes made to
+// upgrade it, if any.
+func readRegistryChanges(path string) (*pdfRegistry, []string, error) {
+	registry_data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeRegistry(registry_data)
+}
+
+func readRegistry(path string) (*pdfRegistry, error) {
+	r, _, err := readRegistryChanges(path)
+	return r, err
+}
+
+// writeRegistryData writes the registry to a temporary file and renames it,
+// so the registry is never left half written.
+func writeRegistryData(path string, registry_data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, registry_data, 0664); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeRegistry(path string, r *pdfRegistry) error {
+	registry_data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return writeRegistryData(path, registry_data)
+}
+
+type registryEntry struct {
+	PDF
+	Seen time.Time // zero if unknown
+}
+
+// entryTime returns the best guess of when the pdf was published: first the
+// time the bot saw it, then the date parsed from the web page.
+func (e *registryEntry) entryTime() time.Time {
+	if !e.Seen.IsZero() {
+		return e.Seen
+	}
+	for _, layout := range []string{DATE_LAYOUT, REGISTRY_OLD_DATE_LAYOUT} {
+		if t, err := time.Parse(layout, e.Date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Entries returns the registry entries sorted from newest to oldest. Entries
+// without any known date go last, sorted by name.
+func (r *pdfRegistry) Entries() []registryEntry {
+	entries := make([]registryEntry, 0, len(r.PDFs))
+	for name, rec := range r.PDFs {
+		entries = append(entries, registryEntry{
+			PDF:  PDF{Name: name, Url: rec.Url, Date: rec.Date, Size: rec.Size},
+			Seen: rec.FirstSeen,
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		ti, tj := entries[i].entryTime(), entries[j].entryTime()
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return entries[i].Name < entries[j].Name
+	})
+
+	return entries
+}
+
+// Search returns the entries whose name contains text, ignoring case, sorted
+// like Entries.
+func (r *pdfRegistry) Search(text string) []registryEntry {
+	text = strings.ToLower(strings.TrimSpace(text))
+
+	var found []registryEntry
+	for _, entry := range r.Entries() {
+		if strings.Contains(strings.ToLower(entry.Name), text) {
+			found = append(found, entry)
+		}
+	}
+
+	return found
+}
+
+// registryKey returns the key a pdf named name gets today, e.g. without the
+// size suffix old registries kept: "Bases (459 KB)" -> "Bases".
+func registryKey(name string) string {
+	pdf := PDF{Name: name}
+	parsePDFName(&pdf)
+	return pdf.Name
+}
+
+// registryDate returns date in the current layout. Old registries stored
+// 2022/12/27 where 27/12/2022 is stored today.
+func registryDate(date string) string {
+	if t, err := time.Parse(REGISTRY_OLD_DATE_LAYOUT, date); err == nil {
+		return t.Format(DATE_LAYOUT)
+	}
+	return date
+}
+
+// mergeEntry fills the blank fields of dst with those of src, keeping the
+// earliest first seen and the latest last seen times.
+func mergeEntry(dst, src *PDFRecord) {
+	if dst.Url == "" {
+		dst.Url = src.Url
+	}
+	if dst.Date == "" {
+		dst.Date = src.Date
+	}
+	if !src.FirstSeen.IsZero() && (dst.FirstSeen.IsZero() || src.FirstSeen.Before(dst.FirstSeen)) {
+		dst.FirstSeen = src.FirstSeen
+	}
+	if src.LastSeen.After(dst.LastSeen) {
+		dst.LastSeen = src.LastSeen
+	}
+	if dst.Size == 0 {
+		dst.Size = src.Size
+	}
+	if dst.Hash == "" {
+		dst.Hash = src.Hash
+	}
+	for chat, d := range src.Deliveries {
+		if _, ok := dst.Deliveries[chat]; !ok {
+			delivery := *d
+			dst.setDelivery(chat, &delivery)
+		}
+	}
+}
+
+// Normalize returns the registry with its keys in the current format and a
+// description of every change. Entries ending with the same key are merged.
+func (r *pdfRegistry) Normalize() (*pdfRegistry, []string) {
+	return r.rewrite(false)
+}
+
+// Migrate returns the registry upgraded to the current format, keys and
+// dates, and a description of every change.
+func (r *pdfRegistry) Migrate() (*pdfRegistry, []string) {
+	return r.rewrite(true)
+}
+
+func (r *pdfRegistry) rewrite(dates bool) (*pdfRegistry, []string) {
+	names := make([]string, 0, len(r.PDFs))
+	for name := range r.PDFs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rewritten := r.clone()
+	rewritten.PDFs = make(map[string]*PDFRecord, len(r.PDFs))
+	var changes []string
+	for _, name := range names {
+		rec := r.PDFs[name].clone()
+
+		key := registryKey(name)
+		if key != name {
+			changes = append(changes, fmt.Sprintf("key %q -> %q", name, key))
+		}
+		if date := registryDate(rec.Date); dates && date != rec.Date {
+			changes = append(changes, fmt.Sprintf("date of %q %s -> %s", key, rec.Date, date))
+			rec.Date = date
+		}
+
+		if existing, ok := rewritten.PDFs[key]; ok {
+			changes = append(changes, fmt.Sprintf("merged %q into %q", name, key))
+			mergeEntry(existing, rec)
+			continue
+		}
+		rewritten.PDFs[key] = rec
+	}
+
+	return rewritten, changes
+}
+
+// registryDiff tells the entries only in one of two registries and those in
+// both with different fields.
+type registryDiff struct {
+	Removed []string // only in the first one
+	Added   []string // only in the second one
+	Changed []string
+}
+
+func diffRegistries(a, b *pdfRegistry) registryDiff {
+	var diff registryDiff
+	for name, rec := range a.PDFs {
+		other, ok := b.PDFs[name]
+		if !ok {
+			diff.Removed = append(diff.Removed, name)
+		} else if !reflect.DeepEqual(rec, other) {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range b.PDFs {
+		if _, ok := a.PDFs[name]; !ok {
+			diff.Added = append(diff.Added, name)
+		}
+	}
+
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Changed)
+	return diff
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const registryUsage = "usage: ./aemet_tg_bot registry <subcommand> [flags] [args]\n\n" +
+	"<registry> is the path of a registry file or, with --bot-config, <chat>/<proc>.\n" +
+	"Registries are locked while changed, the bot may keep running.\n\n" +
+	"subcommands:\n" +
+	"    list      [--bot-config=<path>] [dir]             List the registries of the config or in dir,\n" +
+	"                                                     with how many entries need migrating.\n" +
+	"    show      [--bot-config=<path>] <registry>        Print the entries, newest first.\n" +
+	"    diff      [--bot-config=<path>] <registry> <registry>\n" +
+	"                                                     Print the entries only in one of them or changed.\n" +
+	"    migrate   [--bot-config=<path>] [--dry-run] [<registry>...]\n" +
+	"                                                     Upgrade the registry to the current format,\n" +
+	"                                                     every registry of the config by default. The old\n" +
+	"                                                     file is kept with a .bak suffix.\n" +
+	"    normalize [--bot-config=<path>] [--dry-run] [<registry>...]\n" +
+	"                                                     Like migrate, only rewriting the keys.\n" +
+	"    rm        [--bot-config=<path>] <registry> <name>...\n" +
+	"                                                     Remove entries, they are sent again next round.\n" +
+	"    import    [--bot-config=<path>] <registry> <file> Merge the entries of a registry file, migrated.\n" +
+	"    export    [--bot-config=<path>] [--format=json|csv] <registry>\n" +
+	"                                                     Print the registry to stdout."
+
+// readConfigLayout reads the chats and selective processes of a config,
+// without the secrets the registry commands do not need.
+func readConfigLayout(path string) (*BotConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if data, err = configToJSON(data, configFormatOf(path)); err != nil {
+		return nil, err
+	}
+
+	problems := configProblems{Path: path}
+	var bc BotConfig
+	decodeConfig(data, &bc, &problems)
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+	return &bc, nil
+}
+
+// registryPath resolves a <chat>/<proc> argument through the config, if any.
+// Anything else is a path.
+func registryPath(bc *BotConfig, arg string) string {
+	if bc == nil {
+		return arg
+	}
+	chatName, procName, ok := strings.Cut(arg, "/")
+	if !ok {
+		return arg
+	}
+	if chat := bc.findChat(chatName); chat != nil {
+		if i := chat.findProc(procName); i >= 0 {
+			return chat.SelectiveProcs[i].RegistryPath
+		}
+	}
+	return arg
+}
+
+// configRegistries returns the registry paths of the config, once each.
+func configRegistries(bc *BotConfig) []string {
+	var paths []string
+	seen := map[string]bool{}
+	for _, c := range bc.ChatConfigs {
+		for _, sp := range c.SelectiveProcs {
+			if !seen[filepath.Clean(sp.RegistryPath)] {
+				seen[filepath.Clean(sp.RegistryPath)] = true
+				paths = append(paths, sp.RegistryPath)
+			}
+		}
+	}
+	return paths
+}
+
+func registryStatus(path string) (int, string) {
+	registry, changes, err := readRegistryChanges(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, "missing, run init"
+	} else if err != nil {
+		return 0, "unreadable: " + err.Error()
+	}
+
+	_, migrated := registry.Migrate()
+	if changes = append(changes, migrated...); len(changes) > 0 {
+		return len(registry.PDFs), fmt.Sprintf("%d changes to migrate", len(changes))
+	}
+	return len(registry.PDFs), "ok"
+}
+
+func registryList(bc *BotConfig, args []string) {
+	if bc != nil {
+		for _, c := range bc.ChatConfigs {
+			for _, sp := range c.SelectiveProcs {
+				n, status := registryStatus(sp.RegistryPath)
+				fmt.Printf("%s/%s\t%s\t%d entries\t%s\n", c.Name, sp.Name, sp.RegistryPath, n, status)
+			}
+		}
+		return
+	}
+
+	dir := DEFAULT_REGISTRY_DIR
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		exitf(-1, "Could not list registries in '%s': %s", dir, err)
+	}
+	for _, path := range paths {
+		n, status := registryStatus(path)
+		fmt.Printf("%s\t%d entries\t%s\n", path, n, status)
+	}
+}
+
+func mustReadRegistry(path string) *pdfRegistry {
+	registry, err := readRegistry(path)
+	if err != nil {
+		exitf(-1, "Could not read registry '%s': %s", path, err)
+	}
+	return registry
+}
+
+func registryShow(path string) {
+	for _, entry := range mustReadRegistry(path).Entries() {
+		seen := "-"
+		if !entry.Seen.IsZero() {
+			seen = entry.Seen.UTC().Format("2006-01-02T15:04Z")
+		}
+		date := entry.Date
+		if date == "" {
+			date = "-"
+		}
+		fmt.Printf("%-10s  %-17s  %s\n            %s\n", date, seen, entry.Name, entry.Url)
+	}
+}
+
+func registryDiffCommand(pathA, pathB string) {
+	diff := diffRegistries(mustReadRegistry(pathA), mustReadRegistry(pathB))
+	for _, name := range diff.Removed {
+		fmt.Printf("- %s\n", name)
+	}
+	for _, name := range diff.Added {
+		fmt.Printf("+ %s\n", name)
+	}
+	for _, name := range diff.Changed {
+		fmt.Printf("~ %s\n", name)
+	}
+	if len(diff.Removed)+len(diff.Added)+len(diff.Changed) == 0 {
+		fmt.Println("[INFO] Registries are equal")
+	}
+}
+
+// registryRewrite migrates or normalizes a registry, keeping a backup of the
+// old file.
+func registryRewrite(path string, migrate, dryRun bool) {
+	defer lockRegistry(path)()
+	registry, changes, err := readRegistryChanges(path)
+	if err != nil {
+		exitf(-1, "Could not read registry '%s': %s", path, err)
+	}
+
+	var rewritten *pdfRegistry
+	var rewrites []string
+	if migrate {
+		rewritten, rewrites = registry.Migrate()
+	} else {
+		rewritten, rewrites = registry.Normalize()
+	}
+	changes = append(changes, rewrites...)
+
+	for _, change := range changes {
+		fmt.Printf("%s: %s\n", path, change)
+	}
+	if len(changes) == 0 {
+		fmt.Printf("[INFO] %s: up to date\n", path)
+		return
+	}
+	if dryRun {
+		fmt.Printf("[INFO] %s: %d changes, not written (dry run)\n", path, len(changes))
+		return
+	}
+
+	if err := os.Rename(path, path+".bak"); err != nil {
+		exitf(-1, "Could not back up registry '%s': %s", path, err)
+	}
+	if err := writeRegistry(path, rewritten); err != nil {
+		exitf(-1, "Could not write registry '%s', the old one is at '%s.bak': %s", path, path, err)
+	}
+	fmt.Printf("[INFO] %s: %d changes written, old registry at %s.bak\n", path, len(changes), path)
+}
+
+func registryRm(path string, names []string) {
+	removed := 0
+	err := updateRegistry(path, func(registry *pdfRegistry) bool {
+		for _, name := range names {
+			found := false
+			for key := range registry.PDFs {
+				if key == name || registryKey(key) == registryKey(name) {
+					delete(registry.PDFs, key)
+					fmt.Printf("- %s\n", key)
+					found = true
+					removed++
+				}
+			}
+			if !found {
+				fmt.Printf("[WARN] No entry '%s'\n", name)
+			}
+		}
+		return removed > 0
+	})
+	if err != nil {
+		exitf(-1, "Could not update registry '%s': %s", path, err)
+	}
+
+	if removed > 0 {
+		fmt.Printf("[INFO] %d entries removed from %s\n", removed, path)
+	}
+}
+
+func registryImport(path, file string) {
+	imported, _ := mustReadRegistry(file).Migrate()
+
+	// the bot may be writing the registry
+	defer lockRegistry(path)()
+	registry, err := readRegistry(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		registry = newRegistry("", "")
+	} else if err != nil {
+		exitf(-1, "Could not read registry '%s': %s", path, err)
+	}
+	registry, _ = registry.Migrate()
+
+	for chat, joined := range imported.Chats {
+		registry.joinChat(chat, joined)
+	}
+	added, merged := 0, 0
+	for name, rec := range imported.PDFs {
+		if existing, ok := registry.PDFs[name]; ok {
+			mergeEntry(existing, rec)
+			merged++
+		} else {
+			registry.PDFs[name] = rec
+			added++
+		}
+	}
+
+	if err := writeRegistry(path, registry); err != nil {
+		exitf(-1, "Could not write registry '%s': %s", path, err)
+	}
+	fmt.Printf("[INFO] %s: %d entries added, %d merged\n", path, added, merged)
+}
+
+func registryExport(w io.Writer, path, format string) error {
+	registry := mustReadRegistry(path)
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(registry)
+	case "csv":
+		cw := csv.NewWriter(w)
+		csvTime := func(t time.Time) string {
+			if t.IsZero() {
+				return ""
+			}
+			return t.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{"name", "url", "date", "first_seen", "last_seen", "removed_at", "size", "hash"})
+		for _, entry := range registry.Entries() {
+			rec := registry.PDFs[entry.Name]
+			cw.Write([]string{
+				entry.Name, rec.Url, rec.Date,
+				csvTime(rec.FirstSeen), csvTime(rec.LastSeen), csvTime(rec.RemovedAt),
+				strconv.FormatInt(rec.Size, 10), rec.Hash,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format '%s', use json or csv", format)
+}
+
+func handle_registry_command(args []string) {
+	if len(args) == 0 || args[0] == "help" {
+		fmt.Println(registryUsage)
+		if len(args) == 0 {
+			exitf(-1, "No registry subcommand provided")
+		}
+		return
+	}
+
+	subcommand := args[0]
+	flags := flag.NewFlagSet("registry "+subcommand, flag.ContinueOnError)
+	flags.Usage = func() { fmt.Println(registryUsage) }
+	configPath := flags.String("bot-config", "", "config whose registries are used")
+	flags.StringVar(configPath, "c", "", "shorthand for --bot-config")
+	dryRun := flags.Bool("dry-run", false, "print the changes without writing them")
+	format := flags.String("format", "json", "export format, json or csv")
+	if err := flags.Parse(args[1:]); err != nil {
+		os.Exit(-1)
+	}
+	args = flags.Args()
+
+	var bc *BotConfig
+	if *configPath != "" {
+		var err error
+		if bc, err = readConfigLayout(*configPath); err != nil {
+			exitf(-1, "Could not read bot configuration: %s", err)
+		}
+	}
+
+	needArgs := func(n int) {
+		if len(args) < n {
+			fmt.Println(registryUsage)
+			exitf(-1, "Missing arguments for 'registry %s'", subcommand)
+		}
+	}
+
+	switch subcommand {
+	case "list":
+		registryList(bc, args)
+	case "show":
+		needArgs(1)
+		registryShow(registryPath(bc, args[0]))
+	case "diff":
+		needArgs(2)
+		registryDiffCommand(registryPath(bc, args[0]), registryPath(bc, args[1]))
+	case "migrate", "normalize":
+		paths := args
+		if len(paths) == 0 && bc != nil {
+			paths = configRegistries(bc)
+		}
+		if len(paths) == 0 {
+			fmt.Println(registryUsage)
+			exitf(-1, "No registries given for 'registry %s'", subcommand)
+		}
+		for _, path := range paths {
+			path = registryPath(bc, path)
+			if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) && len(args) == 0 {
+				fmt.Printf("[INFO] %s: missing, skipped\n", path)
+				continue
+			}
+			registryRewrite(path, subcommand == "migrate", *dryRun)
+		}
+	case "rm":
+		needArgs(2)
+		registryRm(registryPath(bc, args[0]), args[1:])
+	case "import":
+		needArgs(2)
+		registryImport(registryPath(bc, args[0]), args[1])
+	case "export":
+		needArgs(1)
+		if err := registryExport(os.Stdout, registryPath(bc, args[0]), *format); err != nil {
+			exitf(-1, "Could not export registry: %s", err)
+		}
+	default:
+		fmt.Println(registryUsage)
+		exitf(-1, "Unknown registry subcommand '%s'", subcommand)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRegistryEntries(t *testing.T) {
+	registry, _ := legacyRegistry{
+		"no date":    {"pdf_url": "url_1", "pdf_date": ""},
+		"old date":   {"pdf_url": "url_2", "pdf_date": "2022/12/27"},
+		"new date":   {"pdf_url": "url_3", "pdf_date": "14/06/2023"},
+		"first seen": {"pdf_url": "url_4", "pdf_date": "", "first_seen": "2024-03-01T10:00:00Z"},
+	}.upgrade()
+
+	want := []string{"first seen", "new date", "old date", "no date"}
+	entries := registry.Entries()
+	if len(entries) != len(want) {
+		t.Fatalf("want: %d entries; got: %d\n", len(want), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Name != want[i] {
+			t.Errorf(errFmtString, want[i], entry.Name)
+		}
+	}
+}
+
+func TestRegistrySearch(t *testing.T) {
+	registry, _ := legacyRegistry{
+		"Listado provisional de admitidos": {"pdf_url": "url_1", "pdf_date": "01/02/2023"},
+		"Listado definitivo de admitidos":  {"pdf_url": "url_2", "pdf_date": "01/03/2023"},
+		"Bases de la convocatoria":         {"pdf_url": "url_3", "pdf_date": "01/01/2023"},
+	}.upgrade()
+
+	want := []string{"Listado definitivo de admitidos", "Listado provisional de admitidos"}
+	found := registry.Search(" listado ")
+	if len(found) != len(want) {
+		t.Fatalf("want: %d entries; got: %d\n", len(want), len(found))
+	}
+	for i, entry := range found {
+		if entry.Name != want[i] {
+			t.Errorf(errFmtString, want[i], entry.Name)
+		}
+	}
+
+	if found := registry.Search("resolución"); len(found) != 0 {
+		t.Errorf("want: no entries; got: %d\n", len(found))
+	}
+}
+
+func TestRegistryUpgrade(t *testing.T) {
+	legacy := legacyRegistry{
+		"Bases de la convocatoria (459 KB)": {"pdf_url": "url_1", "pdf_date": "2022/12/27"},
+		"Bases de la convocatoria":          {"pdf_url": "url_1", "pdf_date": "", "first_seen": "2024-03-01T10:00:00Z"},
+		"Cronograma orientativo (170 KB)":   {"pdf_url": "url_2", "pdf_date": "2023/03/30"},
+		"Listado de admitidos":              {"pdf_url": "url_3", "pdf_date": "14/06/2023"},
+	}
+	data, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatalf("could not encode registry: %s\n", err)
+	}
+
+	upgraded, changes, err := decodeRegistry(data)
+	if err != nil {
+		t.Fatalf("could not decode registry: %s\n", err)
+	}
+	if len(changes) != 4 {
+		t.Errorf("want: version, 2 keys and 1 merge; got: %q\n", changes)
+	}
+
+	seen := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	want := &pdfRegistry{Version: REGISTRY_VERSION, PDFs: map[string]*PDFRecord{
+		"Bases de la convocatoria": {Url: "url_1", Date: "2022/12/27", FirstSeen: seen, Size: 459 << 10},
+		"Cronograma orientativo":   {Url: "url_2", Date: "2023/03/30", Size: 170 << 10},
+		"Listado de admitidos":     {Url: "url_3", Date: "14/06/2023"},
+	}}
+	if diff := diffRegistries(want, upgraded); len(diff.Removed)+len(diff.Added)+len(diff.Changed) != 0 {
+		t.Errorf("want: %+v; got: %+v (%+v)\n", want.PDFs, upgraded.PDFs, diff)
+	}
+
+	if data, err = json.Marshal(upgraded); err != nil {
+		t.Fatalf("could not encode registry: %s\n", err)
+	}
+	if _, changes, err := decodeRegistry(data); err != nil || len(changes) != 0 {
+		t.Errorf("want: upgraded registry up to date; got: %q (%v)\n", changes, err)
+	}
+
+	if _, _, err := decodeRegistry([]byte(`{"Version": 2, "PDFs": {}}`)); err == nil {
+		t.Errorf("want: error on a newer format\n")
+	}
+}
+
+func TestRegistryMigrate(t *testing.T) {
+	seen := time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+	registry := newRegistry("Test1", "url")
+	registry.PDFs["Bases de la convocatoria (459 KB)"] = &PDFRecord{Url: "url_1", Date: "2022/12/27", Deliveries: map[string]*Delivery{"chat_1": {Status: DELIVERY_SENT}}}
+	registry.PDFs["Bases de la convocatoria"] = &PDFRecord{Url: "url_1", FirstSeen: seen, Deliveries: map[string]*Delivery{"chat_2": {Status: DELIVERY_FAILED}}}
+	registry.PDFs["Cronograma orientativo (170 KB)"] = &PDFRecord{Url: "url_2", Date: "2023/03/30"}
+	registry.PDFs["Listado de admitidos"] = &PDFRecord{Url: "url_3", Date: "14/06/2023"}
+
+	normalized, changes := registry.Normalize()
+	if len(changes) != 3 {
+		t.Errorf("want: 2 keys rewritten and 1 merge; got: %q\n", changes)
+	}
+	if date := normalized.PDFs["Cronograma orientativo"].Date; date != "2023/03/30" {
+		t.Errorf("want: date kept by normalize; got: '%s'\n", date)
+	}
+
+	migrated, changes := registry.Migrate()
+	if len(changes) != 5 {
+		t.Errorf("want: 2 keys, 2 dates and 1 merge; got: %q\n", changes)
+	}
+
+	want := &pdfRegistry{PDFs: map[string]*PDFRecord{
+		"Bases de la convocatoria": {Url: "url_1", Date: "27/12/2022", FirstSeen: seen, Deliveries: map[string]*Delivery{
+			"chat_1": {Status: DELIVERY_SENT},
+			"chat_2": {Status: DELIVERY_FAILED},
+		}},
+		"Cronograma orientativo": {Url: "url_2", Date: "30/03/2023"},
+		"Listado de admitidos":   {Url: "url_3", Date: "14/06/2023"},
+	}}
+	if diff := diffRegistries(want, migrated); len(diff.Removed)+len(diff.Added)+len(diff.Changed) != 0 {
+		t.Errorf("want: %+v; got: %+v (%+v)\n", want.PDFs, migrated.PDFs, diff)
+	}
+
+	if _, changes := migrated.Migrate(); len(changes) != 0 {
+		t.Errorf("want: migrated registry up to date; got: %q\n", changes)
+	}
+	if rec := registry.PDFs["Bases de la convocatoria (459 KB)"]; rec.Date != "2022/12/27" || len(registry.PDFs["Bases de la convocatoria"].Deliveries) != 1 {
+		t.Errorf("want: original registry untouched\n")
+	}
+}
+
+func TestDiffRegistries(t *testing.T) {
+	a := newRegistry("", "")
+	a.PDFs["same"] = &PDFRecord{Url: "url_1"}
+	a.PDFs["changed"] = &PDFRecord{Url: "url_2"}
+	a.PDFs["removed"] = &PDFRecord{Url: "url_3"}
+	b := newRegistry("", "")
+	b.PDFs["same"] = &PDFRecord{Url: "url_1"}
+	b.PDFs["changed"] = &PDFRecord{Url: "url_2", Date: "01/01/2024"}
+	b.PDFs["added"] = &PDFRecord{Url: "url_4"}
+
+	diff := diffRegistries(a, b)
+	if len(diff.Removed) != 1 || diff.Removed[0] != "removed" ||
+		len(diff.Added) != 1 || diff.Added[0] != "added" ||
+		len(diff.Changed) != 1 || diff.Changed[0] != "changed" {
+		t.Errorf("want: one removed, added and changed; got: %+v\n", diff)
+	}
+}
+
+func TestWriteRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	registry := newRegistry("Test1", "url")
+	registry.PDFs["Bases"] = &PDFRecord{Url: "url_1", Size: 1024, Hash: "abc"}
+
+	if err := writeRegistry(path, registry); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+	read, err := readRegistry(path)
+	if err != nil || read.Proc != "Test1" || read.PDFs["Bases"].Url != "url_1" || read.PDFs["Bases"].Hash != "abc" {
+		t.Errorf("want: registry read back; got: %+v (%v)\n", read, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want: no temporary file left; got: %v\n", err)
+	}
+}
+
+func TestLockRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := writeRegistry(path, newRegistry("Test1", "url")); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+
+	// another process, like the registry command, opens the lock file itself
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0664)
+	if err != nil {
+		t.Fatalf("could not open lock file: %s\n", err)
+	}
+	defer f.Close()
+
+	unlock := lockRegistry(path)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); !errors.Is(err, syscall.EWOULDBLOCK) {
+		t.Errorf("want: lock file locked; got: %v\n", err)
+	}
+	unlock()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Errorf("want: lock file released; got: %s\n", err)
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+func TestUpdateRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := writeRegistry(path, newRegistry("Test1", "url")); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+
+	// the bot writes the registry after the command first read it
+	registry := newRegistry("Test1", "url")
+	registry.PDFs["Bases"] = &PDFRecord{Url: "url_1"}
+	if err := writeRegistry(path, registry); err != nil {
+		t.Fatalf("could not write registry: %s\n", err)
+	}
+
+	err := updateRegistry(path, func(r *pdfRegistry) bool {
+		r.PDFs["Anexo"] = &PDFRecord{Url: "url_2"}
+		return true
+	})
+	read, _ := readRegistry(path)
+	if err != nil || read.PDFs["Bases"] == nil || read.PDFs["Anexo"] == nil {
+		t.Errorf("want: both entries kept; got: %+v (%v)\n", read, err)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	tele "gopkg.in/telebot.v3"
+	"html"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often the config file is checked for changes.
+const CONFIG_POLL_INTERVAL = 10 * time.Second
+
+// diffConfigs describes, one change per line, how to go from old to new.
+func diffConfigs(old, new *BotConfig) []string {
+	var changes []string
+
+	if old.TimeInterval != new.TimeInterval {
+		changes = append(changes, fmt.Sprintf("~ TimeInterval: %s -> %s", old.TimeInterval, new.TimeInterval))
+	}
+
+	oldAdmins, newAdmins := map[string]string{}, map[string]string{}
+	for _, admin := range old.allAdminChats() {
+		oldAdmins[admin.Name] = admin.ChatId
+	}
+	for _, admin := range new.allAdminChats() {
+		newAdmins[admin.Name] = admin.ChatId
+	}
+	for _, admin := range old.allAdminChats() {
+		if _, ok := newAdmins[admin.Name]; !ok {
+			changes = append(changes, fmt.Sprintf("- admin chat %s", admin.Name))
+		}
+	}
+	for _, admin := range new.allAdminChats() {
+		if chatId, ok := oldAdmins[admin.Name]; !ok {
+			changes = append(changes, fmt.Sprintf("+ admin chat %s", admin.Name))
+		} else if chatId != admin.ChatId {
+			changes = append(changes, fmt.Sprintf("~ admin chat %s: ChatId", admin.Name))
+		}
+	}
+	if strings.Join(old.AdminUserIds, ",") != strings.Join(new.AdminUserIds, ",") {
+		changes = append(changes, fmt.Sprintf("~ AdminUserIds: %d -> %d users", len(old.AdminUserIds), len(new.AdminUserIds)))
+	}
+	if !reflect.DeepEqual(old.Roles, new.Roles) {
+		changes = append(changes, fmt.Sprintf("~ Roles: %d -> %d bindings", len(old.Roles), len(new.Roles)))
+	}
+	if old.AuditLogPath != new.AuditLogPath {
+		changes = append(changes, fmt.Sprintf("~ AuditLogPath: '%s' -> '%s'", old.AuditLogPath, new.AuditLogPath))
+	}
+	if !reflect.DeepEqual(old.Log, new.Log) {
+		changes = append(changes, "~ Log (takes effect on restart)")
+	}
+	if old.MetricsAddress != new.MetricsAddress {
+		changes = append(changes, fmt.Sprintf("~ MetricsAddress: '%s' -> '%s' (takes effect on restart)", old.MetricsAddress, new.MetricsAddress))
+	}
+
+	for _, oc := range old.ChatConfigs {
+		if new.findChat(oc.Name) == nil {
+			changes = append(changes, fmt.Sprintf("- chat %s", oc.Name))
+		}
+	}
+
+	for _, nc := range new.ChatConfigs {
+		oc := old.findChat(nc.Name)
+		if oc == nil {
+			changes = append(changes, fmt.Sprintf("+ chat %s", nc.Name))
+			for _, sp := range nc.SelectiveProcs {
+				changes = append(changes, fmt.Sprintf("+ proc %s/%s", nc.Name, sp.Name))
+			}
+			continue
+		}
+
+		if oc.ChatId != nc.ChatId {
+			changes = append(changes, fmt.Sprintf("~ chat %s: ChatId", nc.Name))
+		}
+
+		for _, osp := range oc.SelectiveProcs {
+			if nc.findProc(osp.Name) < 0 {
+				changes = append(changes, fmt.Sprintf("- proc %s/%s", nc.Name, osp.Name))
+			}
+		}
+
+		for _, nsp := range nc.SelectiveProcs {
+			i := oc.findProc(nsp.Name)
+			if i < 0 {
+				changes = append(changes, fmt.Sprintf("+ proc %s/%s", nc.Name, nsp.Name))
+				continue
+			}
+
+			osp := oc.SelectiveProcs[i]
+			var fields []string
+			if osp.Url != nsp.Url {
+				fields = append(fields, "Url")
+			}
+			if osp.TemplatePath != nsp.TemplatePath {
+				fields = append(fields, "TemplatePath")
+			}
+			if osp.RegistryPath != nsp.RegistryPath {
+				fields = append(fields, "RegistryPath")
+			}
+			if osp.Backfill != nsp.Backfill {
+				fields = append(fields, "Backfill")
+			}
+			if len(fields) > 0 {
+				changes = append(changes, fmt.Sprintf("~ proc %s/%s: %s", nc.Name, nsp.Name, strings.Join(fields, ", ")))
+			}
+		}
+	}
+
+	return changes
+}
+
+// Reload reads the config file again and, if it is valid, replaces the live
+// configuration with it. It returns the list of changes applied. The file is
+// read holding the lock, so a concurrent Update is never lost.
+func (lc *liveConfig) Reload() ([]string, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	modTime := fileModTime(lc.path)
+	bc, err := loadConfig(lc.path)
+	lc.modTime = modTime // so a broken file is reported once, not on every poll
+	if err != nil {
+		return nil, err
+	}
+
+	if bc.Name != lc.bc.Name {
+		return nil, fmt.Errorf("bot Name cannot change without a restart ('%s' -> '%s')", lc.bc.Name, bc.Name)
+	}
+
+	changes := diffConfigs(&lc.bc, &bc)
+	lc.bc = bc
+
+	return changes, nil
+}
+
+// changedOnDisk tells whether the config file was modified after it was last
+// read or written by the bot.
+func (lc *liveConfig) changedOnDisk() bool {
+	lc.mu.RLock()
+	defer lc.mu.RUnlock()
+
+	modTime := fileModTime(lc.path)
+	return !modTime.IsZero() && !modTime.Equal(lc.modTime)
+}
+
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// reloadConfig reloads the live configuration and formats the result for the
+// admin chat. The error sink queues of the sinks removed or edited are stopped.
+func reloadConfig(bot *tele.Bot, lc *liveConfig, reason string) string {
+	slog.Info("Reloading bot configuration", "reason", reason)
+
+	changes, err := lc.Reload()
+	if err != nil {
+		slog.Error("Could not reload bot configuration, keeping the current one", "error", err)
+		return fmt.Sprintf("Could not reload configuration (%s), keeping the current one:\n<pre>%s</pre>",
+			html.EscapeString(reason), html.EscapeString(err.Error()))
+	}
+	pruneSinkQueues(bot, lc.Get())
+
+	if len(changes) == 0 {
+		slog.Info("Bot configuration reloaded, no changes")
+		return fmt.Sprintf("Configuration reloaded (%s), no changes", html.EscapeString(reason))
+	}
+
+	slog.Info("Bot configuration reloaded", "changes", strings.Join(changes, "; "))
+	return fmt.Sprintf("Configuration reloaded (%s):\n<pre>%s</pre>",
+		html.EscapeString(reason), html.EscapeString(strings.Join(changes, "\n")))
+}
+
+// watchConfig reloads the configuration on SIGHUP and whenever the config file
+// changes, reporting the result to the admin chat.
+func watchConfig(bot *tele.Bot, lc *liveConfig) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(CONFIG_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		var msg string
+		select {
+		case <-sighup:
+			msg = reloadConfig(bot, lc, "SIGHUP")
+		case <-ticker.C:
+			if !lc.changedOnDisk() {
+				continue
+			}
+			msg = reloadConfig(bot, lc, "file changed")
+		}
+
+		sendToAdmins(bot, lc.Get(), msg)
+	}
+}
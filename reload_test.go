@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	old := BotConfig{
+		TimeInterval: Duration(time.Second),
+		ChatConfigs: []ChatConfig{
+			{Name: "chat_1", SelectiveProcs: []SelectiveProc{{Name: "Test1", Url: "url_1"}, {Name: "Test2"}}},
+			{Name: "chat_2"},
+		},
+	}
+	new := BotConfig{
+		TimeInterval: Duration(2 * time.Second),
+		ChatConfigs: []ChatConfig{
+			{Name: "chat_1", SelectiveProcs: []SelectiveProc{{Name: "Test1", Url: "url_2"}, {Name: "Test3"}}},
+			{Name: "chat_3", SelectiveProcs: []SelectiveProc{{Name: "Test1"}}},
+		},
+	}
+
+	want := []string{
+		"~ TimeInterval: 1s -> 2s",
+		"- chat chat_2",
+		"- proc chat_1/Test2",
+		"~ proc chat_1/Test1: Url",
+		"+ proc chat_1/Test3",
+		"+ chat chat_3",
+		"+ proc chat_3/Test1",
+	}
+	changes := diffConfigs(&old, &new)
+	if strings.Join(changes, "\n") != strings.Join(want, "\n") {
+		t.Errorf(errFmtString, strings.Join(want, "; "), strings.Join(changes, "; "))
+	}
+
+	if changes := diffConfigs(&old, &old); len(changes) != 0 {
+		t.Errorf("want: no changes; got: %s\n", changes)
+	}
+}
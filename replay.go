@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Pause between the messages of a replay. Telegram allows about 20 messages
+// a minute in a group.
+const REPLAY_SEND_INTERVAL = 3 * time.Second
+
+// parseSince reads the --since date of replay.
+func parseSince(value string) (time.Time, error) {
+	for _, layout := range []string{time.DateOnly, DATE_LAYOUT, time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date '%s', use 2024-03-01, 01/03/2024 or RFC 3339", value)
+}
+
+// replayEntries returns the entries to replay to chat, oldest first: those
+// seen since since or, if it is zero, those whose delivery to the chat failed
+// or is missing, and with includeSkipped those skipped too.
+func replayEntries(r *pdfRegistry, chat string, since time.Time, includeSkipped bool) []registryEntry {
+	entries := r.Entries()
+
+	var replay []registryEntry
+	for i := len(entries) - 1; i >= 0; i-- {
+		rec := r.PDFs[entries[i].Name]
+		if !rec.RemovedAt.IsZero() {
+			continue
+		}
+		if since.IsZero() {
+			if d, ok := rec.Deliveries[chat]; ok && !replayable(d, includeSkipped) {
+				continue
+			}
+		} else if entries[i].entryTime().Before(since) {
+			continue
+		}
+		replay = append(replay, entries[i])
+	}
+	return replay
+}
+
+// replayable tells whether a delivery is replayed without --since.
+func replayable(d *Delivery, includeSkipped bool) bool {
+	return d.Status == DELIVERY_FAILED || (d.Status == DELIVERY_SKIPPED && includeSkipped)
+}
+
+// handle_replay_command sends the chat the pdfs of its selective process it
+// missed, or those seen since sinceValue, oldest first, recording every
+// delivery. With dryRun the messages are printed instead. The registry is read
+// again before every write, so the bot may keep running.
+func handle_replay_command(configPath, chatName, procName, sinceValue string, includeSkipped, dryRun bool) {
+	if chatName == "" || procName == "" {
+		exitf(-1, "--chat and --proc are required")
+	}
+
+	var since time.Time
+	if sinceValue != "" {
+		var err error
+		if since, err = parseSince(sinceValue); err != nil {
+			exitf(-1, "%s", err)
+		}
+	}
+
+	// a dry run needs no secrets
+	var bc *BotConfig
+	if dryRun {
+		var err error
+		if bc, err = readConfigLayout(configPath); err != nil {
+			exitf(-1, "Could not read bot configuration: %s", err)
+		}
+	} else {
+		bc = &BotConfig{}
+		if err := bc.SetUp(configPath); err != nil {
+			os.Exit(-1)
+		}
+	}
+
+	chat := bc.findChat(chatName)
+	if chat == nil {
+		exitf(-1, "Unknown chat '%s'", chatName)
+	}
+	i := chat.findProc(procName)
+	if i < 0 {
+		exitf(-1, "Chat '%s' has no selective process '%s'", chat.Name, procName)
+	}
+	sp := &chat.SelectiveProcs[i]
+
+	template, err := os.ReadFile(sp.TemplatePath)
+	if err != nil {
+		exitf(-1, "Could not read template '%s': %s", sp.TemplatePath, err)
+	}
+	registry := mustReadRegistry(sp.RegistryPath)
+
+	entries := replayEntries(registry, chat.Name, since, includeSkipped)
+	if len(entries) == 0 {
+		fmt.Printf("[INFO] Nothing to replay to %s/%s\n", chat.Name, sp.Name)
+		return
+	}
+
+	if dryRun {
+		for _, entry := range entries {
+			fmt.Printf("%s\n    %s\n", entry.Name, formatPDFMessage(string(template), sp, entry.PDF))
+		}
+		fmt.Printf("[INFO] %d pdfs would be sent to %s/%s (dry run)\n", len(entries), chat.Name, sp.Name)
+		return
+	}
+
+	bot, err := newTeleBot(bc)
+	if err != nil {
+		os.Exit(-1)
+	}
+
+	// setDelivery records the delivery of the entry in the registry as it is
+	// now, as the bot may have written it meanwhile. Claiming an entry before
+	// sending it fails if it was removed or, without --since, delivered since
+	// the registry was first read.
+	setDelivery := func(name string, d *Delivery, claiming bool) bool {
+		recorded := false
+		err := updateRegistry(sp.RegistryPath, func(r *pdfRegistry) bool {
+			r.joinChat(chat.Name, time.Now().UTC())
+			rec, ok := r.PDFs[name]
+			switch {
+			case claiming && !ok:
+				return true
+			case claiming && since.IsZero():
+				if prev := rec.Deliveries[chat.Name]; prev != nil && !replayable(prev, includeSkipped) {
+					return true
+				}
+			case !ok: // removed while sending, e.g. by registry rm
+				rec = registry.PDFs[name].clone()
+				r.PDFs[name] = rec
+			}
+			rec.setDelivery(chat.Name, d)
+			recorded = true
+			return true
+		})
+		if err != nil {
+			exitf(-1, "Could not update registry '%s': %s", sp.RegistryPath, err)
+		}
+		return recorded
+	}
+
+	sent, gone := 0, 0
+	for n, entry := range entries {
+		if n > 0 {
+			time.Sleep(REPLAY_SEND_INTERVAL)
+		}
+
+		// like in a round, the delivery is written before sending
+		if !setDelivery(entry.Name, &Delivery{Status: DELIVERY_FAILED, At: time.Now().UTC(), Error: "not sent, interrupted"}, true) {
+			fmt.Printf("[INFO] '%s' was sent or removed meanwhile, skipped\n", entry.Name)
+			gone++
+			continue
+		}
+
+		msg, err := sendPDF(bot, bc.Name, chat, sp, string(template), entry.PDF)
+		if err != nil {
+			fmt.Printf("[WARN] Could not send '%s': %s\n", entry.Name, err)
+			setDelivery(entry.Name, &Delivery{Status: DELIVERY_FAILED, At: time.Now().UTC(), Error: err.Error()}, false)
+		} else {
+			fmt.Printf("+ %s\n", entry.Name)
+			setDelivery(entry.Name, &Delivery{Status: DELIVERY_SENT, At: time.Now().UTC(), MessageId: msg.ID}, false)
+			sent++
+		}
+	}
+
+	fmt.Printf("[INFO] %d of %d pdfs sent to %s/%s\n", sent, len(entries)-gone, chat.Name, sp.Name)
+	if sent < len(entries)-gone {
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayEntries(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, time.March, d, 10, 0, 0, 0, time.UTC) }
+	registry := newRegistry("Test1", "url")
+	registry.PDFs["sent"] = &PDFRecord{FirstSeen: day(1), Deliveries: map[string]*Delivery{"chat_1": {Status: DELIVERY_SENT}}}
+	registry.PDFs["failed"] = &PDFRecord{FirstSeen: day(2), Deliveries: map[string]*Delivery{"chat_1": {Status: DELIVERY_FAILED}}}
+	registry.PDFs["skipped"] = &PDFRecord{FirstSeen: day(3), Deliveries: map[string]*Delivery{"chat_1": {Status: DELIVERY_SKIPPED}}}
+	registry.PDFs["other chat"] = &PDFRecord{FirstSeen: day(4), Deliveries: map[string]*Delivery{"chat_2": {Status: DELIVERY_SENT}}}
+	registry.PDFs["removed"] = &PDFRecord{FirstSeen: day(5), RemovedAt: day(6)}
+
+	tests := []struct {
+		name           string
+		since          time.Time
+		includeSkipped bool
+		want           []string
+	}{
+		{"Failed or missing", time.Time{}, false, []string{"failed", "other chat"}},
+		{"Include skipped", time.Time{}, true, []string{"failed", "skipped", "other chat"}},
+		{"Since", day(1), false, []string{"sent", "failed", "skipped", "other chat"}},
+		{"Since later", day(3), false, []string{"skipped", "other chat"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := replayEntries(registry, "chat_1", test.since, test.includeSkipped)
+			if len(entries) != len(test.want) {
+				t.Fatalf("want: %q; got: %+v\n", test.want, entries)
+			}
+			for i, entry := range entries {
+				if entry.Name != test.want[i] {
+					t.Errorf(errFmtString, test.want[i], entry.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	want := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+	for _, value := range []string{"2024-03-01", "01/03/2024", "2024-03-01T00:00:00Z"} {
+		if got, err := parseSince(value); err != nil || !got.Equal(want) {
+			t.Errorf("want: %s for '%s'; got: %s (%v)\n", want, value, got, err)
+		}
+	}
+	if _, err := parseSince("yesterday"); err == nil {
+		t.Errorf("want: error on invalid date\n")
+	}
+}
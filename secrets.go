@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// Default name of the dotenv file, looked up next to the config file.
+const DEFAULT_ENV_FILE = ".env"
+
+// Inline references to secrets in config strings: ${VAR}.
+var secretRefRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// secretResolver looks secrets up by name in, in order: the environment, the
+// file named by the <NAME>_FILE variable (Docker and Kubernetes secrets) and
+// the dotenv file.
+type secretResolver struct {
+	dotEnv map[string]string
+}
+
+// parseDotEnv reads a dotenv file: KEY=VALUE lines, optionally prefixed by
+// 'export' and with quoted values. Blank lines and '#' comments are skipped.
+func parseDotEnv(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[key] = value
+	}
+
+	return vars, scanner.Err()
+}
+
+// newSecretResolver builds a resolver for the config at configPath. envFile,
+// relative to the config directory, must exist if given; otherwise the
+// default dotenv file is used when present.
+func newSecretResolver(configPath, envFile string) (*secretResolver, error) {
+	r := &secretResolver{dotEnv: map[string]string{}}
+
+	optional := envFile == ""
+	if optional {
+		envFile = DEFAULT_ENV_FILE
+	}
+	if !filepath.IsAbs(envFile) {
+		envFile = filepath.Join(filepath.Dir(configPath), envFile)
+	}
+
+	vars, err := parseDotEnv(envFile)
+	if err != nil {
+		if optional && errors.Is(err, os.ErrNotExist) {
+			return r, nil
+		}
+		return nil, err
+	}
+
+	r.dotEnv = vars
+	return r, nil
+}
+
+// Lookup returns the value of the secret name and whether it was found. An
+// error means the secret is configured but could not be read.
+func (r *secretResolver) Lookup(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+
+	if path, ok := os.LookupEnv(name + "_FILE"); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("could not read secret file '%s' from %s_FILE: %w", path, name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+
+	if value, ok := r.dotEnv[name]; ok {
+		return value, true, nil
+	}
+
+	return "", false, nil
+}
+
+// lookupInto sets *dst to the secret name, reporting it at field if missing.
+func (r *secretResolver) lookupInto(dst *string, name, field string, problems *configProblems) {
+	value, ok, err := r.Lookup(name)
+	switch {
+	case err != nil:
+		problems.Add(field, "%s", err)
+	case !ok:
+		problems.Add(field, "secret '%s' is unset (looked up in the environment, %s_FILE and the env file)", name, name)
+	default:
+		*dst = value
+	}
+}
+
+// rawString is a config string before its ${VAR} references were expanded.
+type rawString struct {
+	Raw      string
+	Expanded string
+}
+
+// expandString replaces the ${VAR} references in s.
+func (r *secretResolver) expandString(s, field string, problems *configProblems) string {
+	return secretRefRegexp.ReplaceAllStringFunc(s, func(ref string) string {
+		name := secretRefRegexp.FindStringSubmatch(ref)[1]
+		value, ok, err := r.Lookup(name)
+		if err != nil {
+			problems.Add(field, "%s", err)
+		} else if !ok {
+			problems.Add(field, "secret '%s' referenced as '%s' is unset", name, ref)
+		}
+		return value
+	})
+}
+
+// walkStrings calls f with every settable string in v, its field path and
+// its key. Keys name the elements of slices by their Name, if they have one,
+// so they still point to the same field after other elements are removed,
+// e.g. ChatConfigs["chat_1"].SelectiveProcs["Test1"].Url.
+func walkStrings(v reflect.Value, path, key string, f func(s *string, field, key string)) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			walkStrings(v.Elem(), path, key, f)
+		}
+	case reflect.Struct:
+		for i := range v.NumField() {
+			if field := v.Type().Field(i); field.IsExported() {
+				walkStrings(v.Field(i), fieldPath(path, field.Name), fieldPath(key, field.Name), f)
+			}
+		}
+	case reflect.Slice:
+		for i := range v.Len() {
+			elemKey := fmt.Sprintf("%s[%d]", key, i)
+			if name := elemName(v.Index(i)); name != "" {
+				elemKey = fmt.Sprintf("%s[%q]", key, name)
+			}
+			walkStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i), elemKey, f)
+		}
+	case reflect.String:
+		f(v.Addr().Interface().(*string), path, key)
+	}
+}
+
+// elemName returns the Name field of a struct, or pointer to one, if any.
+func elemName(v reflect.Value) string {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if name := v.FieldByName("Name"); name.IsValid() && name.Kind() == reflect.String {
+		return name.String()
+	}
+	return ""
+}
+
+// expandSecrets replaces the ${VAR} references in every config string. The
+// raw strings are kept so WriteFile can write the references back.
+func (r *secretResolver) expandSecrets(bc *BotConfig, problems *configProblems) {
+	bc.rawStrings = map[string]rawString{}
+	walkStrings(reflect.ValueOf(bc), "", "", func(s *string, field, key string) {
+		if !secretRefRegexp.MatchString(*s) {
+			return
+		}
+		raw := *s
+		*s = r.expandString(raw, field, problems)
+		bc.rawStrings[key] = rawString{Raw: raw, Expanded: *s}
+	})
+}
+
+// restoreSecretRefs puts back the ${VAR} references of the strings that still
+// hold their expanded value, or were blanked by obfuscate. Strings of chats
+// and selective processes removed since are dropped with them.
+func restoreSecretRefs(bc *BotConfig) {
+	if len(bc.rawStrings) == 0 {
+		return
+	}
+	walkStrings(reflect.ValueOf(bc), "", "", func(s *string, field, key string) {
+		if raw, ok := bc.rawStrings[key]; ok && (*s == raw.Expanded || *s == "") {
+			*s = raw.Raw
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDotEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	data := "# comment\n\nBOT_TOKEN_bot=12\nexport CHAT_1=\"34\"\nCHAT_2 = '56'\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("could not write env file: %s\n", err)
+	}
+
+	vars, err := parseDotEnv(path)
+	if err != nil {
+		t.Fatalf("could not parse env file: %s\n", err)
+	}
+
+	want := map[string]string{"BOT_TOKEN_bot": "12", "CHAT_1": "34", "CHAT_2": "56"}
+	if len(vars) != len(want) {
+		t.Errorf("want: %d vars; got: %d\n", len(want), len(vars))
+	}
+	for k, v := range want {
+		if vars[k] != v {
+			t.Errorf(errFmtString, v, vars[k])
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("NOT A VAR\n"), 0600); err != nil {
+		t.Fatalf("could not write env file: %s\n", err)
+	}
+	if _, err := parseDotEnv(path); err == nil {
+		t.Errorf("want: error for invalid line; got: nil\n")
+	}
+}
+
+func TestSecretResolverLookup(t *testing.T) {
+	dir := t.TempDir()
+	secretPath := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretPath, []byte("from_file\n"), 0600); err != nil {
+		t.Fatalf("could not write secret file: %s\n", err)
+	}
+
+	r := &secretResolver{dotEnv: map[string]string{"SECRET_ENV": "from_dotenv", "SECRET_DOTENV": "from_dotenv"}}
+	t.Setenv("SECRET_ENV", "from_env")
+	t.Setenv("SECRET_FILE_FILE", secretPath)
+	t.Setenv("SECRET_BROKEN_FILE", filepath.Join(dir, "missing"))
+
+	var tests = []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"SECRET_ENV", "from_env", true},
+		{"SECRET_FILE", "from_file", true},
+		{"SECRET_DOTENV", "from_dotenv", true},
+		{"SECRET_MISSING", "", false},
+	}
+
+	for _, tt := range tests {
+		value, ok, err := r.Lookup(tt.name)
+		if err != nil {
+			t.Errorf("could not look up '%s': %s\n", tt.name, err)
+		}
+		if value != tt.want || ok != tt.ok {
+			t.Errorf("want: '%s' (%t); got: '%s' (%t)\n", tt.want, tt.ok, value, ok)
+		}
+	}
+
+	if _, _, err := r.Lookup("SECRET_BROKEN"); err == nil {
+		t.Errorf("want: error for unreadable secret file; got: nil\n")
+	}
+}
+
+func TestExpandSecrets(t *testing.T) {
+	t.Setenv("TG_TOKEN", "12")
+	t.Setenv("AEMET_HOST", "www.aemet.es")
+
+	bc := BotConfig{
+		Token:           "${TG_TOKEN}",
+		Name:            "bot_name",
+		ChatAdminConfig: &ChatAdminConfig{Name: "admin_name", ChatId: "${ADMIN_ID}"},
+		ChatConfigs: []ChatConfig{
+			{Name: "chat_1", SelectiveProcs: []SelectiveProc{{Name: "Test1", Url: "https://${AEMET_HOST}/page"}}},
+		},
+	}
+
+	var problems configProblems
+	r := &secretResolver{}
+	r.expandSecrets(&bc, &problems)
+
+	if bc.Token != "12" {
+		t.Errorf(errFmtString, "12", bc.Token)
+	}
+	if url := bc.ChatConfigs[0].SelectiveProcs[0].Url; url != "https://www.aemet.es/page" {
+		t.Errorf(errFmtString, "https://www.aemet.es/page", url)
+	}
+	if len(problems.Problems) != 1 || problems.Problems[0].Field != "ChatAdminConfig.ChatId" {
+		t.Errorf("want: problem in 'ChatAdminConfig.ChatId'; got: '%s'\n", problems.Error())
+	}
+
+	path := filepath.Join(t.TempDir(), "botConfig.json")
+	if err := bc.WriteFile(path); err != nil {
+		t.Fatalf("could not write config: %s\n", err)
+	}
+
+	var written BotConfig
+	if err := written.ReadFile(path); err != nil {
+		t.Fatalf("could not read config: %s\n", err)
+	}
+	if written.Token != "${TG_TOKEN}" {
+		t.Errorf(errFmtString, "${TG_TOKEN}", written.Token)
+	}
+	if url := written.ChatConfigs[0].SelectiveProcs[0].Url; url != "https://${AEMET_HOST}/page" {
+		t.Errorf(errFmtString, "https://${AEMET_HOST}/page", url)
+	}
+}
+
+func TestRestoreSecretRefsAfterRemove(t *testing.T) {
+	t.Setenv("PAGE_2", "https://www.aemet.es/page_2")
+
+	bc := BotConfig{
+		Name: "bot_name",
+		ChatConfigs: []ChatConfig{{Name: "chat_1", SelectiveProcs: []SelectiveProc{
+			{Name: "Test1", Url: "https://www.aemet.es/page_1"},
+			{Name: "Test2", Url: "${PAGE_2}"},
+			{Name: "Test3", Url: "https://www.aemet.es/page_3"},
+		}}},
+	}
+	var problems configProblems
+	r := &secretResolver{}
+	r.expandSecrets(&bc, &problems)
+	if err := problems.Err(); err != nil {
+		t.Fatalf("could not expand secrets: %s\n", err)
+	}
+
+	// like /proc_rm, the processes after the removed one move up
+	procs := bc.ChatConfigs[0].SelectiveProcs
+	bc.ChatConfigs[0].SelectiveProcs = append(procs[:0:0], procs[1:]...)
+
+	path := filepath.Join(t.TempDir(), "botConfig.json")
+	if err := bc.WriteFile(path); err != nil {
+		t.Fatalf("could not write config: %s\n", err)
+	}
+	var written BotConfig
+	if err := written.ReadFile(path); err != nil {
+		t.Fatalf("could not read config: %s\n", err)
+	}
+	want := []string{"${PAGE_2}", "https://www.aemet.es/page_3"}
+	for i, sp := range written.ChatConfigs[0].SelectiveProcs {
+		if sp.Url != want[i] {
+			t.Errorf(errFmtString, want[i], sp.Url)
+		}
+	}
+
+	// the reference goes away with its process
+	bc.ChatConfigs[0].SelectiveProcs = bc.ChatConfigs[0].SelectiveProcs[1:]
+	if err := bc.WriteFile(path); err != nil {
+		t.Fatalf("could not write config: %s\n", err)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "PAGE_2") || strings.Contains(string(data), "page_2") {
+		t.Errorf("want: no trace of the removed process; got:\n%s\n", data)
+	}
+}
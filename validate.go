@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Intervals below this are almost always a duration written in the wrong unit.
+const MIN_TIME_INTERVAL = time.Second
+
+// configProblem is a single problem found in the bot configuration.
+type configProblem struct {
+	Field   string // e.g. ChatConfigs[1].SelectiveProcs[0].Url
+	Message string
+}
+
+func (p configProblem) Error() string {
+	if p.Field == "" {
+		return p.Message
+	}
+	return fmt.Sprintf("%s: %s", p.Field, p.Message)
+}
+
+// configProblems gathers every problem found in a configuration file, so they
+// can all be reported at once.
+type configProblems struct {
+	Path     string
+	Problems []configProblem
+}
+
+func (ps *configProblems) Add(field, format string, a ...any) {
+	ps.Problems = append(ps.Problems, configProblem{Field: field, Message: fmt.Sprintf(format, a...)})
+}
+
+func (ps *configProblems) Error() string {
+	lines := make([]string, len(ps.Problems))
+	for i, p := range ps.Problems {
+		if ps.Path != "" {
+			lines[i] = fmt.Sprintf("%s: %s", ps.Path, p.Error())
+		} else {
+			lines[i] = p.Error()
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Err returns ps as an error, or nil if no problem was found.
+func (ps *configProblems) Err() error {
+	if len(ps.Problems) == 0 {
+		return nil
+	}
+	return ps
+}
+
+func fieldPath(parent, field string) string {
+	if parent == "" {
+		return field
+	}
+	return parent + "." + field
+}
+
+// jsonField finds the field of struct type t that encoding/json would fill
+// with the given key.
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// checkFields reports the keys of the decoded JSON value that do not match any
+// field of type t, and the invalid durations. Other type mismatches are left
+// for json.Unmarshal.
+func checkFields(value any, t reflect.Type, path string, problems *configProblems) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(Duration(0)) {
+		if s, ok := value.(string); ok {
+			var d Duration
+			if err := d.UnmarshalText([]byte(s)); err != nil {
+				problems.Add(path, "invalid duration '%s', use a number of nanoseconds or a duration like \"5m\"", s)
+			}
+		}
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return
+		}
+
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			field, ok := jsonField(t, key)
+			if !ok {
+				problems.Add(fieldPath(path, key), "unknown field")
+				continue
+			}
+			checkFields(obj[key], field.Type, fieldPath(path, field.Name), problems)
+		}
+	case reflect.Slice:
+		arr, ok := value.([]any)
+		if !ok {
+			return
+		}
+		for i, v := range arr {
+			checkFields(v, t.Elem(), fmt.Sprintf("%s[%d]", path, i), problems)
+		}
+	}
+}
+
+// decodeConfig decodes the JSON configuration in data into bc, reporting
+// syntax errors, type errors and unknown fields.
+func decodeConfig(data []byte, bc *BotConfig, problems *configProblems) {
+	var raw any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			problems.Add("", "invalid JSON at offset %d: %s", syntaxErr.Offset, err)
+		} else {
+			problems.Add("", "invalid JSON: %s", err)
+		}
+		return
+	}
+
+	n_problems := len(problems.Problems)
+	checkFields(raw, reflect.TypeOf(bc), "", problems)
+
+	if err := json.Unmarshal(data, bc); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			problems.Add(typeErr.Field, "cannot use %s as %s", typeErr.Value, typeErr.Type)
+		} else if len(problems.Problems) == n_problems {
+			// errors from custom decoders have no field, checkFields
+			// usually reports them already with their location
+			problems.Add("", "%s", err)
+		}
+	}
+}
+
+func checkName(field, name string, problems *configProblems) {
+	if strings.TrimSpace(name) == "" {
+		problems.Add(field, "must not be empty")
+	} else if strings.ContainsAny(name, " \t\n") {
+		problems.Add(field, "'%s' must not contain spaces", name)
+	}
+}
+
+// checkConfig reports every problem of an already decoded configuration.
+func checkConfig(bc *BotConfig, problems *configProblems) {
+	checkName("Name", bc.Name, problems)
+
+	if bc.TimeInterval <= 0 {
+		problems.Add("TimeInterval", "must be positive, got %s", bc.TimeInterval)
+	} else if bc.TimeInterval.Duration() < MIN_TIME_INTERVAL {
+		problems.Add("TimeInterval", "%s is too short, use at least %s (numbers are nanoseconds, prefer a duration like \"5m\")", bc.TimeInterval, MIN_TIME_INTERVAL)
+	}
+
+	if bc.MetricsAddress != "" {
+		if _, port, err := net.SplitHostPort(bc.MetricsAddress); err != nil {
+			problems.Add("MetricsAddress", "'%s' is not a listen address like ':9090': %s", bc.MetricsAddress, err)
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems.Add("MetricsAddress", "'%s' has an invalid port", bc.MetricsAddress)
+		}
+	}
+
+	if bc.Health != nil {
+		if bc.Health.MaxSchedulerDelay < 0 {
+			problems.Add("Health.MaxSchedulerDelay", "must not be negative, got %s", bc.Health.MaxSchedulerDelay)
+		}
+		if bc.Health.MaxRoundAge < 0 {
+			problems.Add("Health.MaxRoundAge", "must not be negative, got %s", bc.Health.MaxRoundAge)
+		} else if bc.Health.MaxRoundAge > 0 && bc.Health.MaxRoundAge < bc.TimeInterval {
+			problems.Add("Health.MaxRoundAge", "%s is shorter than TimeInterval %s, every proc would look stale", bc.Health.MaxRoundAge, bc.TimeInterval)
+		}
+	}
+
+	if bc.Log != nil {
+		checkLogConfig(bc.Log, "Log", problems)
+	}
+
+	if bc.Errors != nil {
+		checkErrorsConfig(bc, problems)
+	}
+
+	admins := map[string]string{}
+	checkAdmin := func(field string, admin *ChatAdminConfig) {
+		checkName(field+".Name", admin.Name, problems)
+		if prev, ok := admins[strings.ToLower(admin.Name)]; ok && admin.Name != "" {
+			problems.Add(field+".Name", "duplicated admin chat name '%s', already used by %s", admin.Name, prev)
+		} else {
+			admins[strings.ToLower(admin.Name)] = field
+		}
+	}
+	if bc.ChatAdminConfig != nil {
+		checkAdmin("ChatAdminConfig", bc.ChatAdminConfig)
+	}
+	for i := range bc.AdminChats {
+		checkAdmin(fmt.Sprintf("AdminChats[%d]", i), &bc.AdminChats[i])
+	}
+
+	for i, id := range bc.AdminUserIds {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			problems.Add(fmt.Sprintf("AdminUserIds[%d]", i), "'%s' is not a Telegram user id", id)
+		}
+	}
+
+	chats := map[string]string{}
+	type registryUser struct {
+		field string
+		chat  int
+		url   string
+	}
+	registries := map[string]registryUser{}
+	for i, c := range bc.ChatConfigs {
+		chatField := fmt.Sprintf("ChatConfigs[%d]", i)
+
+		checkName(chatField+".Name", c.Name, problems)
+		if prev, ok := chats[strings.ToLower(c.Name)]; ok && c.Name != "" {
+			problems.Add(chatField+".Name", "duplicated chat name '%s', already used by %s", c.Name, prev)
+		} else {
+			chats[strings.ToLower(c.Name)] = chatField
+		}
+
+		procs := map[string]string{}
+		for j, sp := range c.SelectiveProcs {
+			spField := fmt.Sprintf("%s.SelectiveProcs[%d]", chatField, j)
+
+			checkName(spField+".Name", sp.Name, problems)
+			if prev, ok := procs[strings.ToLower(sp.Name)]; ok && sp.Name != "" {
+				problems.Add(spField+".Name", "duplicated selective process name '%s', already used by %s", sp.Name, prev)
+			} else {
+				procs[strings.ToLower(sp.Name)] = spField
+			}
+
+			if u, err := url.Parse(sp.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				problems.Add(spField+".Url", "'%s' is not an http(s) url", sp.Url)
+			}
+
+			if sp.TemplatePath == "" {
+				problems.Add(spField+".TemplatePath", "must not be empty")
+			} else if _, err := os.ReadFile(sp.TemplatePath); err != nil {
+				problems.Add(spField+".TemplatePath", "could not read template: %s", err)
+			}
+
+			if sp.RegistryPath == "" {
+				problems.Add(spField+".RegistryPath", "must not be empty")
+			} else {
+				// chats watching the same page share its registry
+				if prev, ok := registries[filepath.Clean(sp.RegistryPath)]; !ok {
+					registries[filepath.Clean(sp.RegistryPath)] = registryUser{spField, i, sp.Url}
+				} else if prev.chat == i {
+					problems.Add(spField+".RegistryPath", "registry '%s' already used by %s of the same chat", sp.RegistryPath, prev.field)
+				} else if prev.url != sp.Url {
+					problems.Add(spField+".RegistryPath", "registry '%s' already used by %s for another url, '%s'", sp.RegistryPath, prev.field, prev.url)
+				}
+
+				if info, err := os.Stat(filepath.Dir(sp.RegistryPath)); err != nil {
+					problems.Add(spField+".RegistryPath", "registry directory: %s", err)
+				} else if !info.IsDir() {
+					problems.Add(spField+".RegistryPath", "'%s' is not a directory", filepath.Dir(sp.RegistryPath))
+				}
+			}
+		}
+	}
+
+	for i, r := range bc.Roles {
+		roleField := fmt.Sprintf("Roles[%d]", i)
+
+		if _, ok := parseRole(r.Role); !ok {
+			problems.Add(roleField+".Role", "unknown role '%s', use viewer, operator, admin or owner", r.Role)
+		}
+		if len(r.UserIds) == 0 && len(r.Chats) == 0 {
+			problems.Add(roleField, "grants the role to nobody, set UserIds or Chats")
+		}
+		for j, id := range r.UserIds {
+			if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+				problems.Add(fmt.Sprintf("%s.UserIds[%d]", roleField, j), "'%s' is not a Telegram user id", id)
+			}
+		}
+		for j, name := range r.Chats {
+			if _, ok := bc.chatIdByName(name); !ok {
+				problems.Add(fmt.Sprintf("%s.Chats[%d]", roleField, j), "unknown chat '%s'", name)
+			}
+		}
+	}
+}
+
+// checkBots reports the problems of running the bots configured at paths in
+// the same process: their names, tokens and registries must be distinct.
+func checkBots(paths []string, bcs []BotConfig) error {
+	var problems configProblems
+
+	names, tokens, registries := map[string]string{}, map[string]string{}, map[string]string{}
+	for i, bc := range bcs {
+		if prev, ok := names[strings.ToLower(bc.Name)]; ok {
+			problems.Add(paths[i]+": Name", "bot name '%s' already used by %s", bc.Name, prev)
+		} else {
+			names[strings.ToLower(bc.Name)] = paths[i]
+		}
+
+		if prev, ok := tokens[bc.Token]; ok {
+			problems.Add(paths[i]+": Token", "token already used by %s", prev)
+		} else {
+			tokens[bc.Token] = paths[i]
+		}
+
+		// registries shared within a bot are reported by checkConfig
+		own := map[string]string{}
+		for j, c := range bc.ChatConfigs {
+			for k, sp := range c.SelectiveProcs {
+				field := fmt.Sprintf("%s: ChatConfigs[%d].SelectiveProcs[%d].RegistryPath", paths[i], j, k)
+				if prev, ok := registries[filepath.Clean(sp.RegistryPath)]; ok {
+					problems.Add(field, "registry '%s' already used by %s", sp.RegistryPath, prev)
+				}
+				own[filepath.Clean(sp.RegistryPath)] = field
+			}
+		}
+		for path, field := range own {
+			registries[path] = field
+		}
+	}
+
+	return problems.Err()
+}
+
+// validateConfig checks the configuration is usable by the scheduler.
+func validateConfig(bc *BotConfig) error {
+	var problems configProblems
+	checkConfig(bc, &problems)
+	return problems.Err()
+}
+
+// loadConfig reads, completes and validates the configuration at path. All
+// the problems found are returned together in a *configProblems error.
+func loadConfig(path string) (BotConfig, error) {
+	problems := configProblems{Path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		problems.Add("", "could not read configuration: %s", err)
+		return BotConfig{}, problems.Err()
+	}
+
+	if data, err = configToJSON(data, configFormatOf(path)); err != nil {
+		problems.Add("", "%s", err)
+		return BotConfig{}, problems.Err()
+	}
+
+	var bc BotConfig
+	decodeConfig(data, &bc, &problems)
+	if len(problems.Problems) > 0 {
+		// the decoded config is incomplete, further checks would be misleading
+		return BotConfig{}, problems.Err()
+	}
+
+	secrets, err := newSecretResolver(path, bc.EnvFile)
+	if err != nil {
+		problems.Add("EnvFile", "%s", err)
+		secrets = &secretResolver{}
+	}
+	secrets.expandSecrets(&bc, &problems)
+
+	var secretProblems *configProblems
+	if err := loadSecrets(&bc, secrets); errors.As(err, &secretProblems) {
+		problems.Problems = append(problems.Problems, secretProblems.Problems...)
+	} else if err != nil {
+		problems.Add("", "%s", err)
+	}
+
+	checkConfig(&bc, &problems)
+
+	if err := problems.Err(); err != nil {
+		return BotConfig{}, err
+	}
+	return bc, nil
+}
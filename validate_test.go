@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.txt")
+	if err := os.WriteFile(template, []byte("%s%s%s%s"), 0664); err != nil {
+		t.Fatalf("could not write template: %s\n", err)
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		bc := BotConfig{
+			Name:         "bot_name",
+			TimeInterval: Duration(time.Minute),
+			ChatConfigs: []ChatConfig{
+				{Name: "chat_1", SelectiveProcs: []SelectiveProc{
+					{Name: "Test1", TemplatePath: template, RegistryPath: filepath.Join(dir, "r1.json"), Url: "https://www.aemet.es/1"},
+					{Name: "Test2", TemplatePath: template, RegistryPath: filepath.Join(dir, "r2.json"), Url: "https://www.aemet.es/2"},
+				}},
+				{Name: "chat_2", SelectiveProcs: []SelectiveProc{
+					{Name: "Test1", TemplatePath: template, RegistryPath: filepath.Join(dir, "r1.json"), Url: "https://www.aemet.es/1", Backfill: true},
+				}},
+			},
+		}
+		if err := validateConfig(&bc); err != nil {
+			t.Errorf("want: no error; got: '%s'\n", err)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		bc := BotConfig{
+			Name:           "",
+			TimeInterval:   5,
+			MetricsAddress: "9090",
+			ChatConfigs: []ChatConfig{
+				{Name: "chat_1", SelectiveProcs: []SelectiveProc{
+					{Name: "Test1", TemplatePath: template, RegistryPath: filepath.Join(dir, "r1.json"), Url: "ftp://www.aemet.es"},
+					{Name: "Test1", TemplatePath: "missing.txt", RegistryPath: filepath.Join(dir, "r1.json"), Url: "https://www.aemet.es"},
+				}},
+				{Name: "chat_1"},
+				{Name: "chat_2", SelectiveProcs: []SelectiveProc{
+					{Name: "Test1", TemplatePath: template, RegistryPath: filepath.Join(dir, "r1.json"), Url: "https://www.aemet.es/1"},
+				}},
+			},
+			Roles: []RoleBinding{
+				{Role: "operator", UserIds: []string{"42"}, Chats: []string{"chat_1"}},
+				{Role: "root", UserIds: []string{"@someone"}, Chats: []string{"chat_3"}},
+				{Role: "viewer"},
+			},
+		}
+
+		want := []string{
+			"Name",
+			"TimeInterval",
+			"MetricsAddress",
+			"ChatConfigs[0].SelectiveProcs[0].Url",
+			"ChatConfigs[0].SelectiveProcs[1].Name",
+			"ChatConfigs[0].SelectiveProcs[1].TemplatePath",
+			"ChatConfigs[0].SelectiveProcs[1].RegistryPath",
+			"ChatConfigs[1].Name",
+			"ChatConfigs[2].SelectiveProcs[0].RegistryPath",
+			"Roles[1].Role",
+			"Roles[1].UserIds[0]",
+			"Roles[1].Chats[0]",
+			"Roles[2]",
+		}
+
+		var problems configProblems
+		checkConfig(&bc, &problems)
+		if len(problems.Problems) != len(want) {
+			t.Fatalf("want: %d problems; got: %d ('%s')\n", len(want), len(problems.Problems), problems.Error())
+		}
+		for i, p := range problems.Problems {
+			if p.Field != want[i] {
+				t.Errorf(errFmtString, want[i], p.Field)
+			}
+		}
+	})
+}
+
+func TestCheckBots(t *testing.T) {
+	newBot := func(name, token string, registries ...string) BotConfig {
+		bc := BotConfig{Name: name, Token: token, ChatConfigs: []ChatConfig{{Name: "chat"}}}
+		for _, r := range registries {
+			bc.ChatConfigs[0].SelectiveProcs = append(bc.ChatConfigs[0].SelectiveProcs, SelectiveProc{RegistryPath: r})
+		}
+		return bc
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		bcs := []BotConfig{newBot("bot_1", "token_1", "r1.json"), newBot("bot_2", "token_2", "r2.json")}
+		if err := checkBots([]string{"a.json", "b.json"}, bcs); err != nil {
+			t.Errorf("want: no error; got: '%s'\n", err)
+		}
+	})
+
+	t.Run("Shared", func(t *testing.T) {
+		bcs := []BotConfig{newBot("bot_1", "token_1", "r1.json"), newBot("BOT_1", "token_1", "./r1.json", "r2.json")}
+
+		want := []string{
+			"b.json: Name",
+			"b.json: Token",
+			"b.json: ChatConfigs[0].SelectiveProcs[0].RegistryPath",
+		}
+
+		var problems *configProblems
+		if !errors.As(checkBots([]string{"a.json", "b.json"}, bcs), &problems) {
+			t.Fatalf("want: *configProblems error\n")
+		}
+		if len(problems.Problems) != len(want) {
+			t.Fatalf("want: %d problems; got: %d ('%s')\n", len(want), len(problems.Problems), problems.Error())
+		}
+		for i, p := range problems.Problems {
+			if p.Field != want[i] {
+				t.Errorf(errFmtString, want[i], p.Field)
+			}
+		}
+	})
+}
+
+func TestDecodeConfig(t *testing.T) {
+	t.Run("UnknownFields", func(t *testing.T) {
+		data := `{"Name": "bot", "Interval": 5, "ChatConfigs": [{"Name": "chat", "SelectiveProcs": [{"name": "Test1", "Template": "x"}]}]}`
+
+		want := []string{"ChatConfigs[0].SelectiveProcs[0].Template", "Interval"}
+
+		var bc BotConfig
+		var problems configProblems
+		decodeConfig([]byte(data), &bc, &problems)
+		if len(problems.Problems) != len(want) {
+			t.Fatalf("want: %d problems; got: %d ('%s')\n", len(want), len(problems.Problems), problems.Error())
+		}
+		for i, p := range problems.Problems {
+			if p.Field != want[i] {
+				t.Errorf(errFmtString, want[i], p.Field)
+			}
+		}
+		if bc.ChatConfigs[0].SelectiveProcs[0].Name != "Test1" {
+			t.Errorf(errFmtString, "Test1", bc.ChatConfigs[0].SelectiveProcs[0].Name)
+		}
+	})
+
+	t.Run("WrongType", func(t *testing.T) {
+		var bc BotConfig
+		var problems configProblems
+		decodeConfig([]byte(`{"Name": "bot", "TimeInterval": "5 minutes"}`), &bc, &problems)
+		if len(problems.Problems) != 1 || problems.Problems[0].Field != "TimeInterval" {
+			t.Errorf("want: problem in 'TimeInterval'; got: '%s'\n", problems.Error())
+		}
+	})
+}
+
+func TestLoadConfigReportsAll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "botConfig.json")
+	data := `{"Name": "bot", "TimeInterval": 0, "ChatAdminConfig": {"Name": "admin"}, "ChatConfigs": [{"Name": "chat"}]}`
+	if err := os.WriteFile(path, []byte(data), 0664); err != nil {
+		t.Fatalf("could not write config: %s\n", err)
+	}
+
+	_, err := loadConfig(path)
+	var problems *configProblems
+	if !errors.As(err, &problems) {
+		t.Fatalf("want: *configProblems; got: '%v'\n", err)
+	}
+
+	// 3 env vars unset and the interval
+	if len(problems.Problems) != 4 {
+		t.Errorf("want: 4 problems; got: %d ('%s')\n", len(problems.Problems), err)
+	}
+	if !strings.HasPrefix(err.Error(), path+": ") {
+		t.Errorf("want: problems prefixed with '%s'; got: '%s'\n", path, err)
+	}
+}